@@ -0,0 +1,290 @@
+// Package alerting sits between the collector's alerts and the notifiers:
+// it groups alerts by device, drops duplicates, repeats notifications of
+// alerts which keep firing, routes them to notifiers by severity, and
+// suppresses silenced alerts.
+package alerting
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+// Route sends alerts of the given severities (all, if empty) to the named
+// receivers.
+type Route struct {
+	Severities []string `json:"severities,omitempty"`
+	Receivers  []string `json:"receivers"`
+}
+
+// Config holds the alert manager's settings.  Routes are tried in order;
+// an alert matching none is dropped.  With no routes, every alert goes to
+// every receiver.  By default alerts are notified at once, and not
+// repeated.
+type Config struct {
+	GroupWait      collector.Duration `json:"group_wait,omitempty"`
+	RepeatInterval collector.Duration `json:"repeat_interval,omitempty"`
+	Routes         []Route            `json:"routes,omitempty"`
+}
+
+// LoadConfig reads a JSON Config from path.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Manager is a collector.EventSink managing notification of alert events.
+type Manager struct {
+	mu        sync.Mutex
+	time      clockwork.Clock
+	cfg       Config
+	receivers map[string]collector.EventSink
+	names     []string // of receivers, in order added
+
+	groups map[string]map[string]*entry // by device, then alert name
+
+	silencesFile string
+	silences     []Silence
+}
+
+// entry is the state of one alert of one device.
+type entry struct {
+	event    collector.Event // latest firing or resolution
+	pending  time.Time       // when a change awaiting notification arrived
+	notified time.Time       // when last notified
+}
+
+func (e *entry) firing() bool {
+	return e.event.Type == collector.EventAlertFiring
+}
+
+// New returns a Manager, loading silences from (and saving them to)
+// silencesFile, if set.
+func New(cfg Config, silencesFile string, clock clockwork.Clock) (*Manager, error) {
+	m := &Manager{
+		time:         clock,
+		cfg:          cfg,
+		receivers:    map[string]collector.EventSink{},
+		groups:       map[string]map[string]*entry{},
+		silencesFile: silencesFile,
+	}
+	if silencesFile != "" {
+		if err := m.loadSilences(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Receiver registers sink as the named receiver of alert notifications,
+// returning a sink for it to be given the collector's other events.
+func (m *Manager) Receiver(name string, sink collector.EventSink) collector.EventSink {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.receivers[name] = sink
+	m.names = append(m.names, name)
+	return withoutAlerts{sink}
+}
+
+// withoutAlerts passes on all but alert events, which arrive through the
+// Manager instead.
+type withoutAlerts struct {
+	collector.EventSink
+}
+
+func (s withoutAlerts) HandleEvent(e collector.Event) {
+	if e.Type == collector.EventAlertFiring || e.Type == collector.EventAlertResolved {
+		return
+	}
+	s.EventSink.HandleEvent(e)
+}
+
+// HandleEvent implements collector.EventSink, noting changes in alerts.
+// Without a group wait, they're notified at once.
+func (m *Manager) HandleEvent(e collector.Event) {
+	if e.Alert == nil || (e.Type != collector.EventAlertFiring && e.Type != collector.EventAlertResolved) {
+		return
+	}
+	if m.note(e) && m.cfg.GroupWait == 0 {
+		m.evaluate()
+	}
+}
+
+// note records an alert event, returning whether it's a change.
+func (m *Manager) note(e collector.Event) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[e.Device]
+	if !ok {
+		g = map[string]*entry{}
+		m.groups[e.Device] = g
+	}
+	en, ok := g[e.Alert.Name]
+	if !ok {
+		if e.Type == collector.EventAlertResolved {
+			return false // never seen firing
+		}
+		en = &entry{}
+		g[e.Alert.Name] = en
+	} else if en.event.Type == e.Type {
+		en.event = e // a duplicate; keep the detail current
+		return false
+	}
+	en.event = e
+	en.pending = m.time.Now()
+	return true
+}
+
+// Now is the time according to the Manager's clock.
+func (m *Manager) Now() time.Time {
+	return m.time.Now()
+}
+
+// Alert is an alert known to the Manager.
+type Alert struct {
+	collector.Event
+	Silenced bool      `json:"silenced"`
+	Notified time.Time `json:"notified,omitempty"`
+}
+
+// Alerts lists the alerts firing or awaiting notification of resolution,
+// by device and name.
+func (m *Manager) Alerts() []Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.time.Now()
+	var out []Alert
+	for _, g := range m.groups {
+		for _, en := range g {
+			out = append(out, Alert{Event: en.event, Silenced: m.silenced(en.event, now), Notified: en.notified})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Device != out[j].Device {
+			return out[i].Device < out[j].Device
+		}
+		return out[i].Alert.Name < out[j].Alert.Name
+	})
+	return out
+}
+
+// route returns the receivers of alerts of severity.
+func (m *Manager) route(severity string) []string {
+	if len(m.cfg.Routes) == 0 {
+		return m.names
+	}
+	for _, r := range m.cfg.Routes {
+		if len(r.Severities) == 0 {
+			return r.Receivers
+		}
+		for _, s := range r.Severities {
+			if s == severity {
+				return r.Receivers
+			}
+		}
+	}
+	return nil
+}
+
+// notification is an alert event to be delivered to a receiver.
+type notification struct {
+	sink  collector.EventSink
+	event collector.Event
+}
+
+// evaluate notifies the receivers of each device's alerts once the group
+// has waited for changes to settle, or it's time to repeat those still
+// firing.
+func (m *Manager) evaluate() {
+	m.mu.Lock()
+	now := m.time.Now()
+	var out []notification
+	devices := make([]string, 0, len(m.groups))
+	for d := range m.groups {
+		devices = append(devices, d)
+	}
+	sort.Strings(devices)
+	for _, d := range devices {
+		g := m.groups[d]
+		due := false
+		for _, en := range g {
+			if m.silenced(en.event, now) {
+				continue
+			}
+			if !en.pending.IsZero() && now.Sub(en.pending) >= time.Duration(m.cfg.GroupWait) {
+				due = true
+			}
+			if en.firing() && m.cfg.RepeatInterval > 0 && !en.notified.IsZero() && now.Sub(en.notified) >= time.Duration(m.cfg.RepeatInterval) {
+				due = true
+			}
+		}
+		names := make([]string, 0, len(g))
+		for name := range g {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			en := g[name]
+			if m.silenced(en.event, now) {
+				if !en.firing() {
+					delete(g, name) // resolved while silenced
+				}
+				continue
+			}
+			if !due {
+				continue
+			}
+			// a resolution is only news to those told it was firing
+			if en.firing() || !en.notified.IsZero() {
+				for _, r := range m.route(en.event.Alert.Severity) {
+					if sink, ok := m.receivers[r]; ok {
+						out = append(out, notification{sink, en.event})
+					} else {
+						log.Printf("alert %s of %s routed to unknown receiver %q", name, d, r)
+					}
+				}
+			}
+			en.pending, en.notified = time.Time{}, now
+			if !en.firing() {
+				delete(g, name)
+			}
+		}
+		if len(g) == 0 {
+			delete(m.groups, d)
+		}
+	}
+	m.mu.Unlock()
+	for _, n := range out {
+		n.sink.HandleEvent(n.event)
+	}
+}
+
+// Run evaluates alerts every interval until shutdown.
+func (m *Manager) Run(interval time.Duration, shutdown <-chan bool) {
+	t := m.time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-t.Chan():
+			m.evaluate()
+			m.expireSilences()
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package alerting
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+type recorder struct {
+	events []collector.Event
+}
+
+func (r *recorder) HandleEvent(e collector.Event) {
+	r.events = append(r.events, e)
+}
+
+// take returns "<type> <device> <alert>" for each event received since the
+// last call.
+func (r *recorder) take() []string {
+	var out []string
+	for _, e := range r.events {
+		s := string(e.Type) + " " + e.Device
+		if e.Alert != nil {
+			s += " " + e.Alert.Name
+		}
+		out = append(out, s)
+	}
+	r.events = nil
+	return out
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+var start = time.Date(2024, 3, 12, 20, 0, 0, 0, time.UTC)
+
+func alertEvent(device, name, severity string, firing bool) collector.Event {
+	t := collector.EventAlertResolved
+	if firing {
+		t = collector.EventAlertFiring
+	}
+	return collector.Event{Time: start, Device: device, Type: t,
+		Alert: &collector.Alert{Name: name, Severity: severity, Firing: firing}}
+}
+
+func TestGroupRepeatResolve(t *testing.T) {
+	clock := clockwork.NewFakeClockAt(start)
+	m, err := New(Config{
+		GroupWait:      collector.Duration(30 * time.Second),
+		RepeatInterval: collector.Duration(4 * time.Hour),
+	}, "", clock)
+	if err != nil {
+		t.Fatalf("error creating manager: %v", err)
+	}
+	r := &recorder{}
+	m.Receiver("r", r)
+
+	m.HandleEvent(alertEvent("FFFF", collector.AlertStuckOn, collector.SeverityCritical, true))
+	clock.Advance(10 * time.Second)
+	m.HandleEvent(alertEvent("FFFF", collector.AlertAnomaly, collector.SeverityWarning, true))
+	m.HandleEvent(alertEvent("FFFF", collector.AlertAnomaly, collector.SeverityWarning, true))
+	m.evaluate()
+	if got := r.take(); len(got) != 0 {
+		t.Errorf("want nothing during group wait, got %v", got)
+	}
+	clock.Advance(25 * time.Second)
+	m.evaluate()
+	want := []string{"alert_firing FFFF cycle_anomaly", "alert_firing FFFF stuck_on"}
+	if got := r.take(); !equal(got, want) {
+		t.Errorf("want grouped %v, got %v", want, got)
+	}
+	m.evaluate()
+	if got := r.take(); len(got) != 0 {
+		t.Errorf("want no duplicates, got %v", got)
+	}
+
+	clock.Advance(4 * time.Hour)
+	m.evaluate()
+	if got := r.take(); !equal(got, want) {
+		t.Errorf("want repeated %v, got %v", want, got)
+	}
+
+	m.HandleEvent(alertEvent("FFFF", collector.AlertAnomaly, collector.SeverityWarning, false))
+	clock.Advance(time.Minute)
+	m.evaluate()
+	want = []string{"alert_resolved FFFF cycle_anomaly", "alert_firing FFFF stuck_on"}
+	if got := r.take(); !equal(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if alerts := m.Alerts(); len(alerts) != 1 || alerts[0].Alert.Name != collector.AlertStuckOn {
+		t.Errorf("want resolved alert forgotten, got %+v", alerts)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	clock := clockwork.NewFakeClockAt(start)
+	m, err := New(Config{}, "", clock)
+	if err != nil {
+		t.Fatalf("error creating manager: %v", err)
+	}
+	r := &recorder{}
+	m.Receiver("r", r)
+	m.HandleEvent(alertEvent("FFFF", collector.AlertStuckOn, collector.SeverityCritical, true))
+	if got, want := r.take(), []string{"alert_firing FFFF stuck_on"}; !equal(got, want) {
+		t.Errorf("want %v at once, got %v", want, got)
+	}
+	m.HandleEvent(alertEvent("FFFF", collector.AlertStuckOn, collector.SeverityCritical, true))
+	clock.Advance(24 * time.Hour)
+	m.evaluate()
+	if got := r.take(); len(got) != 0 {
+		t.Errorf("want no duplicates or repeats, got %v", got)
+	}
+	m.HandleEvent(alertEvent("FFFF", collector.AlertStuckOn, collector.SeverityCritical, false))
+	if got, want := r.take(), []string{"alert_resolved FFFF stuck_on"}; !equal(got, want) {
+		t.Errorf("want %v at once, got %v", want, got)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	clock := clockwork.NewFakeClockAt(start)
+	m, err := New(Config{GroupWait: collector.Duration(30 * time.Second), Routes: []Route{
+		{Severities: []string{collector.SeverityCritical}, Receivers: []string{"pager", "log"}},
+		{Receivers: []string{"log"}},
+	}}, "", clock)
+	if err != nil {
+		t.Fatalf("error creating manager: %v", err)
+	}
+	pager, logged := &recorder{}, &recorder{}
+	m.Receiver("pager", pager)
+	m.Receiver("log", logged)
+	m.HandleEvent(alertEvent("FFFF", collector.AlertStuckOff, collector.SeverityCritical, true))
+	m.HandleEvent(alertEvent("EEEE", collector.AlertAnomaly, collector.SeverityWarning, true))
+	clock.Advance(time.Minute)
+	m.evaluate()
+	if got, want := pager.take(), []string{"alert_firing FFFF stuck_off"}; !equal(got, want) {
+		t.Errorf("want pager to get %v, got %v", want, got)
+	}
+	if got, want := logged.take(), []string{"alert_firing EEEE cycle_anomaly", "alert_firing FFFF stuck_off"}; !equal(got, want) {
+		t.Errorf("want log to get %v, got %v", want, got)
+	}
+}
+
+func TestSilenceNotSaved(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "missing", "silences.json")
+	m, err := New(Config{}, fn, clockwork.NewFakeClockAt(start))
+	if err != nil {
+		t.Fatalf("error creating manager: %v", err)
+	}
+	if _, err := m.AddSilence(Silence{Device: "FFFF", Ends: start.Add(time.Hour)}); err == nil || errors.Is(err, ErrInvalidSilence) {
+		t.Errorf("want error saving silence, got %v", err)
+	}
+	if got := m.Silences(); len(got) != 0 {
+		t.Errorf("want unsaved silence not added, got %+v", got)
+	}
+}
+
+func TestSilences(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "silences.json")
+	clock := clockwork.NewFakeClockAt(start)
+	m, err := New(Config{}, fn, clock)
+	if err != nil {
+		t.Fatalf("error creating manager: %v", err)
+	}
+	r := &recorder{}
+	m.Receiver("r", r)
+	s, err := m.AddSilence(Silence{Device: "FFFF", Ends: start.Add(48 * time.Hour), Comment: "defrosting"})
+	if err != nil {
+		t.Fatalf("error adding silence: %v", err)
+	}
+
+	// silences survive restarts
+	m, err = New(Config{}, fn, clock)
+	if err != nil {
+		t.Fatalf("error recreating manager: %v", err)
+	}
+	m.Receiver("r", r)
+	if got := m.Silences(); len(got) != 1 || got[0].ID != s.ID || got[0].Comment != "defrosting" {
+		t.Fatalf("want silence restored, got %+v", got)
+	}
+
+	m.HandleEvent(alertEvent("FFFF", collector.AlertStuckOff, collector.SeverityCritical, true))
+	m.HandleEvent(alertEvent("EEEE", collector.AlertStuckOff, collector.SeverityCritical, true))
+	clock.Advance(time.Minute)
+	m.evaluate()
+	if got, want := r.take(), []string{"alert_firing EEEE stuck_off"}; !equal(got, want) {
+		t.Errorf("want only unsilenced %v, got %v", want, got)
+	}
+
+	clock.Advance(48 * time.Hour)
+	m.expireSilences()
+	m.evaluate()
+	if got, want := r.take(), []string{"alert_firing FFFF stuck_off"}; !equal(got, want) {
+		t.Errorf("want %v notified once silence ends, got %v", want, got)
+	}
+	if got := m.Silences(); len(got) != 0 {
+		t.Errorf("want silence expired, got %+v", got)
+	}
+	if err := m.DeleteSilence(s.ID); err != ErrNoSuchSilence {
+		t.Errorf("want ErrNoSuchSilence, got %v", err)
+	}
+}
+
+func TestReceiverPassesOtherEvents(t *testing.T) {
+	m, err := New(Config{}, "", clockwork.NewFakeClock())
+	if err != nil {
+		t.Fatalf("error creating manager: %v", err)
+	}
+	r := &recorder{}
+	sink := m.Receiver("r", r)
+	sink.HandleEvent(collector.Event{Device: "FFFF", Type: collector.EventOff})
+	sink.HandleEvent(alertEvent("FFFF", collector.AlertStuckOn, collector.SeverityCritical, true))
+	if got, want := r.take(), []string{"off FFFF"}; !equal(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,158 @@
+package alerting
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+var (
+	ErrNoSuchSilence  = errors.New("no such silence")
+	ErrInvalidSilence = errors.New("invalid silence")
+)
+
+// Silence suppresses notification of matching alerts between Starts and
+// Ends.  Device (an ID, address or alias) and Alert (a name) match all if
+// empty.
+type Silence struct {
+	ID        string    `json:"id"`
+	Device    string    `json:"device,omitempty"`
+	Alert     string    `json:"alert,omitempty"`
+	Starts    time.Time `json:"starts"`
+	Ends      time.Time `json:"ends"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+func (s *Silence) active(now time.Time) bool {
+	return !now.Before(s.Starts) && now.Before(s.Ends)
+}
+
+func (s *Silence) matches(e collector.Event) bool {
+	if s.Alert != "" && (e.Alert == nil || s.Alert != e.Alert.Name) {
+		return false
+	}
+	return s.Device == "" || s.Device == e.Device || s.Device == e.Addr ||
+		(e.Alias != "" && strings.EqualFold(s.Device, e.Alias))
+}
+
+// silenced reports whether any active silence matches e.  The caller must
+// hold m.mu.
+func (m *Manager) silenced(e collector.Event, now time.Time) bool {
+	for i := range m.silences {
+		if m.silences[i].active(now) && m.silences[i].matches(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// Silences lists the current and future silences.
+func (m *Manager) Silences() []Silence {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Silence{}, m.silences...)
+}
+
+// AddSilence adds s, starting now if Starts is unset, returning it with
+// its assigned ID.  Should s not be saved, it isn't added.
+func (m *Manager) AddSilence(s Silence) (Silence, error) {
+	if s.Starts.IsZero() {
+		s.Starts = m.time.Now()
+	}
+	if !s.Ends.After(s.Starts) {
+		return s, fmt.Errorf("%w: ends before it starts", ErrInvalidSilence)
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return s, err
+	}
+	s.ID = hex.EncodeToString(b)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.silences = append(m.silences, s)
+	if err := m.saveSilences(); err != nil {
+		m.silences = m.silences[:len(m.silences)-1]
+		return s, fmt.Errorf("saving silences: %w", err)
+	}
+	log.Printf("added silence %s of %q %q until %s: %s", s.ID, s.Device, s.Alert, s.Ends, s.Comment)
+	return s, nil
+}
+
+// DeleteSilence removes the silence with the given ID.  Should the
+// removal not be saved, the silence is kept.
+func (m *Manager) DeleteSilence(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, s := range m.silences {
+		if s.ID == id {
+			prev := m.silences
+			m.silences = append(append([]Silence{}, prev[:i]...), prev[i+1:]...)
+			if err := m.saveSilences(); err != nil {
+				m.silences = prev
+				return fmt.Errorf("saving silences: %w", err)
+			}
+			log.Printf("deleted silence %s", id)
+			return nil
+		}
+	}
+	return ErrNoSuchSilence
+}
+
+// expireSilences forgets silences which have ended.
+func (m *Manager) expireSilences() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.time.Now()
+	kept := m.silences[:0]
+	for _, s := range m.silences {
+		if now.Before(s.Ends) {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == len(m.silences) {
+		return
+	}
+	m.silences = kept
+	if err := m.saveSilences(); err != nil {
+		log.Printf("error saving silences: %v", err)
+	}
+}
+
+func (m *Manager) loadSilences() error {
+	b, err := os.ReadFile(m.silencesFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &m.silences); err != nil {
+		return fmt.Errorf("decoding %s: %w", m.silencesFile, err)
+	}
+	return nil
+}
+
+// saveSilences writes the silences to the silences file, if any.  The
+// caller must hold m.mu.
+func (m *Manager) saveSilences() error {
+	if m.silencesFile == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(m.silences, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.silencesFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.silencesFile)
+}
@@ -0,0 +1,208 @@
+// Package alertmanager pushes the collector's alerts to Prometheus
+// Alertmanagers through their /api/v2/alerts endpoint.
+package alertmanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+var refreshInterval = flag.Duration("alertmanager-refresh-interval", time.Minute, "Interval at which firing alerts are re-sent to Alertmanager")
+
+const queueSize = 100
+
+// Alert is an alert as posted to Alertmanager.
+type Alert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// Pusher is a collector.EventSink posting alerts to Alertmanagers as they
+// fire and resolve, and re-posting those firing so that Alertmanager
+// doesn't consider them resolved.
+type Pusher struct {
+	collector    *collector.Collector
+	urls         []string
+	generatorURL string
+	client       *http.Client
+	queue        chan []Alert
+	done         chan struct{}
+	time         clockwork.Clock
+
+	mu     sync.Mutex
+	closed bool // queue
+}
+
+// New returns a Pusher posting to the Alertmanagers at urls (such as
+// http://localhost:9093).  generatorURL, if set, links alerts back to the
+// exporter.
+func New(c *collector.Collector, urls []string, generatorURL string, clock clockwork.Clock) *Pusher {
+	p := &Pusher{
+		collector:    c,
+		generatorURL: generatorURL,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		queue:        make(chan []Alert, queueSize),
+		done:         make(chan struct{}),
+		time:         clock,
+	}
+	for _, u := range urls {
+		p.urls = append(p.urls, strings.TrimSuffix(u, "/")+"/api/v2/alerts")
+	}
+	go p.run()
+	return p
+}
+
+func (p *Pusher) run() {
+	defer close(p.done)
+	for alerts := range p.queue {
+		for _, u := range p.urls {
+			if err := p.post(u, alerts); err != nil {
+				log.Printf("error posting %d alerts to %s: %v", len(alerts), u, err)
+			}
+		}
+	}
+}
+
+func (p *Pusher) post(url string, alerts []Alert) error {
+	b, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+func (p *Pusher) enqueue(alerts []Alert) {
+	if len(alerts) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.queue <- alerts:
+	default:
+		log.Printf("Alertmanager queue full, dropping %d alerts", len(alerts))
+	}
+}
+
+// Close sends any queued alerts.  Any later are dropped.
+func (p *Pusher) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	<-p.done
+}
+
+// endsAt is when Alertmanager should consider a firing alert resolved if
+// not refreshed.
+func (p *Pusher) endsAt() time.Time {
+	return p.time.Now().Add(4 * *refreshInterval)
+}
+
+// alert converts one of a device's alerts.
+func (p *Pusher) alert(id collector.Identity, a collector.Alert) Alert {
+	name := id.Alias
+	if name == "" {
+		name = id.DeviceID
+	}
+	labels := map[string]string{
+		"alertname": a.Name,
+		"severity":  a.Severity,
+		"device_id": id.DeviceID,
+		"job":       "kasadutycycle",
+	}
+	for k, v := range map[string]string{"alias": id.Alias, "addr": id.Addr, "mac": id.MAC, "model": id.Model} {
+		if v != "" {
+			labels[k] = v
+		}
+	}
+	out := Alert{
+		Labels: labels,
+		Annotations: map[string]string{
+			"summary": fmt.Sprintf("%s: %s", name, a.Name),
+		},
+		StartsAt:     a.Since,
+		EndsAt:       p.endsAt(),
+		GeneratorURL: p.generatorURL,
+	}
+	if a.Detail != "" {
+		out.Annotations["description"] = a.Detail
+	}
+	if !a.Firing {
+		out.EndsAt = a.Resolved
+	}
+	return out
+}
+
+// identity returns the identity of an event's device.
+func (p *Pusher) identity(e collector.Event) collector.Identity {
+	if id, ok := p.collector.Identify(e.Device); ok {
+		return id
+	}
+	return collector.Identity{DeviceID: e.Device, Addr: e.Addr, Alias: e.Alias}
+}
+
+// HandleEvent implements collector.EventSink, posting alerts as they fire
+// and resolve.
+func (p *Pusher) HandleEvent(e collector.Event) {
+	if e.Alert == nil || (e.Type != collector.EventAlertFiring && e.Type != collector.EventAlertResolved) {
+		return
+	}
+	p.enqueue([]Alert{p.alert(p.identity(e), *e.Alert)})
+}
+
+// refresh re-posts every firing alert.
+func (p *Pusher) refresh() {
+	var alerts []Alert
+	p.collector.Lock()
+	for _, m := range p.collector.Monitors {
+		for _, a := range m.State.FiringAlerts() {
+			alerts = append(alerts, p.alert(m.Identity(), a))
+		}
+	}
+	p.collector.Unlock()
+	p.enqueue(alerts)
+}
+
+// Run refreshes firing alerts every -alertmanager-refresh-interval until
+// shutdown, starting with those firing now.
+func (p *Pusher) Run(shutdown <-chan bool) {
+	p.refresh()
+	t := p.time.NewTicker(*refreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-t.Chan():
+			p.refresh()
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package alertmanager
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+// fakeAlertmanager records the alerts posted to it.
+type fakeAlertmanager struct {
+	mu     sync.Mutex
+	posted [][]Alert
+}
+
+func (f *fakeAlertmanager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/api/v2/alerts" {
+		http.NotFound(w, r)
+		return
+	}
+	var alerts []Alert
+	if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.posted = append(f.posted, alerts)
+	f.mu.Unlock()
+}
+
+func (f *fakeAlertmanager) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.posted)
+}
+
+func (f *fakeAlertmanager) take() [][]Alert {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	posted := f.posted
+	f.posted = nil
+	return posted
+}
+
+func TestPush(t *testing.T) {
+	fake := &fakeAlertmanager{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	now := time.Date(2024, 3, 12, 20, 0, 0, 0, time.UTC)
+	clock := clockwork.NewFakeClockAt(now)
+	c := collector.New([]string{"127.0.0.1"}, "", clock)
+	m := c.MonitorAt("127.0.0.1")
+	m.State.Timestamp = now
+	m.State.Alias = "freezer"
+	alert := collector.Alert{Name: collector.AlertStuckOff, Severity: collector.SeverityCritical,
+		Firing: true, Since: now.Add(-time.Hour), Detail: "off for 7h0m0s, limit 6h0m0s"}
+	m.State.Alerts = map[string]collector.Alert{alert.Name: alert}
+
+	p := New(c, []string{srv.URL + "/"}, "http://exporter:8080/", clock)
+	p.HandleEvent(collector.Event{Time: now, Device: "127.0.0.1", Type: collector.EventAlertFiring, Alert: &alert})
+	// Run refreshes at once, and then every -alertmanager-refresh-interval
+	shutdown := make(chan bool)
+	go p.Run(shutdown)
+	clock.BlockUntil(1)
+	clock.Advance(*refreshInterval)
+	for deadline := time.Now().Add(5 * time.Second); fake.count() < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for refreshes")
+		}
+	}
+	close(shutdown)
+	resolved := alert
+	resolved.Firing, resolved.Resolved = false, now.Add(time.Minute)
+	p.HandleEvent(collector.Event{Time: now, Device: "127.0.0.1", Type: collector.EventAlertResolved, Alert: &resolved})
+	p.Close()
+
+	posted := fake.take()
+	if len(posted) != 4 {
+		t.Fatalf("want 4 posts (firing, two refreshes, resolved), got %d", len(posted))
+	}
+	for i, batch := range posted {
+		if len(batch) != 1 {
+			t.Fatalf("want 1 alert in post %d, got %d", i, len(batch))
+		}
+		a := batch[0]
+		if a.Labels["alertname"] != "stuck_off" || a.Labels["severity"] != "critical" ||
+			a.Labels["alias"] != "freezer" || a.Labels["addr"] != "127.0.0.1" {
+			t.Errorf("unexpected labels %v", a.Labels)
+		}
+		if a.Annotations["description"] != alert.Detail || a.GeneratorURL != "http://exporter:8080/" {
+			t.Errorf("unexpected alert %+v", a)
+		}
+		if !a.StartsAt.Equal(alert.Since) {
+			t.Errorf("want startsAt %s, got %s", alert.Since, a.StartsAt)
+		}
+	}
+	if ends := posted[2][0].EndsAt; !ends.After(now.Add(*refreshInterval)) {
+		t.Errorf("want refreshed alert to end in the future, got %s", ends)
+	}
+	if ends := posted[3][0].EndsAt; !ends.Equal(resolved.Resolved) {
+		t.Errorf("want resolved alert to end at %s, got %s", resolved.Resolved, ends)
+	}
+}
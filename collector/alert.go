@@ -0,0 +1,156 @@
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+var stuckOnAfter = flag.Duration("stuck-on-after", 0, "Alert when a device has been ON for longer than this (0 to disable, unless set per device)")
+var stuckOffAfter = flag.Duration("stuck-off-after", 0, "Alert when a device has been OFF for longer than this (0 to disable, unless set per device)")
+
+const (
+	EventAlertFiring   EventType = "alert_firing"
+	EventAlertResolved EventType = "alert_resolved"
+)
+
+// Built-in alert names.
+const (
+	AlertStuckOn  = "stuck_on"
+	AlertStuckOff = "stuck_off"
+	AlertAnomaly  = "cycle_anomaly"
+)
+
+const (
+	SeverityCritical = "critical"
+	SeverityWarning  = "warning"
+)
+
+// AlertRules overrides the -stuck-on-after and -stuck-off-after limits for
+// a device.  A negative duration disables the rule.
+type AlertRules struct {
+	StuckOn  Duration `json:"stuck_on,omitempty"`
+	StuckOff Duration `json:"stuck_off,omitempty"`
+}
+
+// Alert is the state of one of a device's alert rules.
+type Alert struct {
+	Name     string    `json:"name"`
+	Severity string    `json:"severity"`
+	Firing   bool      `json:"firing"`
+	Since    time.Time `json:"since"` // when it last fired
+	Resolved time.Time `json:"resolved,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// FiringAlerts returns m's firing alerts, ordered by name.
+func (s *MonitorState) FiringAlerts() []Alert {
+	var alerts []Alert
+	for _, a := range s.Alerts {
+		if a.Firing {
+			alerts = append(alerts, a)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Name < alerts[j].Name })
+	return alerts
+}
+
+// alertLimits returns the stuck-on and stuck-off limits for m, zero where
+// disabled.
+func (c *Collector) alertLimits(m *Monitor) (stuckOn, stuckOff time.Duration) {
+	stuckOn, stuckOff = *stuckOnAfter, *stuckOffAfter
+	if r := c.deviceConfig(m).Alerts; r != nil {
+		if r.StuckOn != 0 {
+			stuckOn = time.Duration(r.StuckOn)
+		}
+		if r.StuckOff != 0 {
+			stuckOff = time.Duration(r.StuckOff)
+		}
+	}
+	return max(stuckOn, 0), max(stuckOff, 0)
+}
+
+// offSince is when m last stopped being ON, including by losing power.
+func (s *MonitorState) offSince() time.Time {
+	if s.LastOn.After(s.LastOff) && len(s.Transitions) > 0 {
+		return s.Transitions[len(s.Transitions)-1].Time
+	}
+	return s.LastOff
+}
+
+// evaluateAlerts updates the state of m's alert rules, recording events as
+// they fire and resolve.  The caller must hold the Collector's lock.
+func (c *Collector) evaluateAlerts(m *Monitor, now time.Time) {
+	if m.State.Timestamp.IsZero() {
+		return
+	}
+	stuckOn, stuckOff := c.alertLimits(m)
+
+	var firing bool
+	var detail string
+	if d := now.Sub(m.State.LastOn); stuckOn > 0 && m.State.CycleState && !m.State.LastOn.IsZero() {
+		firing, detail = d > stuckOn, fmt.Sprintf("on for %s, limit %s", d.Round(time.Second), stuckOn)
+	}
+	m.setAlert(now, AlertStuckOn, SeverityCritical, firing, detail)
+
+	firing, detail = false, ""
+	if since := m.State.offSince(); stuckOff > 0 && !m.State.CycleState && !since.IsZero() {
+		d := now.Sub(since)
+		firing, detail = d > stuckOff, fmt.Sprintf("off for %s, limit %s", d.Round(time.Second), stuckOff)
+	}
+	m.setAlert(now, AlertStuckOff, SeverityCritical, firing, detail)
+
+	firing, detail = false, ""
+	for _, p := range []struct {
+		phase string
+		score float64
+	}{{"on", m.State.OnAnomalyScore}, {"off", m.State.OffAnomalyScore}} {
+		if math.Abs(p.score) >= *anomalyThreshold {
+			firing, detail = true, fmt.Sprintf("last %s phase %.1f standard deviations from baseline", p.phase, p.score)
+			break
+		}
+	}
+	m.setAlert(now, AlertAnomaly, SeverityWarning, firing, detail)
+}
+
+// setAlert records the current state of one of m's alert rules.
+func (m *Monitor) setAlert(now time.Time, name, severity string, firing bool, detail string) {
+	a, ok := m.State.Alerts[name]
+	if !ok && !firing {
+		return
+	}
+	if m.State.Alerts == nil {
+		m.State.Alerts = map[string]Alert{}
+	}
+	a.Name, a.Severity = name, severity
+	if detail != "" {
+		a.Detail = detail
+	}
+	t := EventAlertFiring
+	switch {
+	case firing && !a.Firing:
+		a.Firing, a.Since, a.Resolved = true, now, time.Time{}
+	case !firing && a.Firing:
+		a.Firing, a.Resolved = false, now
+		t = EventAlertResolved
+	default:
+		m.State.Alerts[name] = a
+		return
+	}
+	m.State.Alerts[name] = a
+	log.Printf("%s: %s %s: %s", m.ID(), t, name, a.Detail)
+	m.add(Event{Time: now, Type: t, Detail: a.Detail, Alert: &a})
+}
+
+// checkAlerts evaluates every device's alert rules.
+func (c *Collector) checkAlerts() {
+	c.Lock()
+	defer c.Unlock()
+	now := c.time.Now()
+	for _, m := range c.Monitors {
+		c.evaluateAlerts(m, now)
+	}
+}
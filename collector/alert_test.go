@@ -0,0 +1,66 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func TestStuckAlerts(t *testing.T) {
+	now := mustParseTime(time.RFC3339, "2020-03-12T20:00:00.000000-00:00")
+	c := New([]string{"127.0.0.1"}, "", clockwork.NewFakeClockAt(now))
+	c.config["127.0.0.1"] = DeviceConfig{Alerts: &AlertRules{
+		StuckOn:  Duration(time.Hour),
+		StuckOff: Duration(2 * time.Hour),
+	}}
+	mon := c.MonitorAt("127.0.0.1")
+	clock := c.time.(clockwork.FakeClock)
+	firing := func() []string {
+		var names []string
+		for _, a := range mon.State.FiringAlerts() {
+			names = append(names, a.Name)
+		}
+		return names
+	}
+
+	mon.sample(clock.Now(), sysinfoResponse, rtOn)
+	clock.Advance(30 * time.Minute)
+	c.checkAlerts()
+	if f := firing(); len(f) != 0 {
+		t.Errorf("want no alerts firing, got %v", f)
+	}
+	clock.Advance(31 * time.Minute)
+	c.checkAlerts()
+	if f := firing(); len(f) != 1 || f[0] != AlertStuckOn {
+		t.Fatalf("want %s firing, got %v", AlertStuckOn, f)
+	}
+
+	mon.sample(clock.Now(), sysinfoResponse, rtOff)
+	c.checkAlerts()
+	if f := firing(); len(f) != 0 {
+		t.Errorf("want stuck-on resolved, got %v", f)
+	}
+	clock.Advance(3 * time.Hour)
+	c.checkAlerts()
+	if f := firing(); len(f) != 1 || f[0] != AlertStuckOff {
+		t.Fatalf("want %s firing, got %v", AlertStuckOff, f)
+	}
+
+	var types []EventType
+	for _, e := range mon.State.Events {
+		if e.Alert != nil {
+			types = append(types, e.Type)
+		}
+	}
+	want := []EventType{EventAlertFiring, EventAlertResolved, EventAlertFiring}
+	if len(types) != len(want) {
+		t.Fatalf("want alert events %v, got %v", want, types)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Errorf("want alert events %v, got %v", want, types)
+			break
+		}
+	}
+}
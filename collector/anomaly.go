@@ -0,0 +1,81 @@
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+var anomalyAlpha = flag.Float64("anomaly-alpha", 0.05, "Weight of each new cycle in the learned baseline of cycle durations")
+var anomalyThreshold = flag.Float64("anomaly-threshold", 3, "Standard deviations from the baseline beyond which a cycle is anomalous")
+var anomalyWarmup = flag.Int("anomaly-warmup", 20, "Cycles to learn from before flagging anomalies")
+
+const EventAnomaly EventType = "anomaly"
+
+// Baseline is an exponentially-weighted moving mean and variance of phase
+// durations, in seconds.
+type Baseline struct {
+	Count    int     `json:"count"`
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+}
+
+func (b *Baseline) stddev() float64 {
+	return math.Sqrt(b.Variance)
+}
+
+// score is how many standard deviations x lies from the mean; 0 until the
+// baseline has warmed up.
+func (b *Baseline) score(x float64) float64 {
+	if b.Count < *anomalyWarmup || b.Variance == 0 {
+		return 0
+	}
+	return (x - b.Mean) / b.stddev()
+}
+
+// update folds x into the baseline.  Once warmed up, x is clamped to the
+// anomaly threshold so that a single outlier can't skew the baseline much,
+// though a sustained change will still be learned.
+func (b *Baseline) update(x float64) {
+	if b.Count == 0 {
+		b.Count, b.Mean, b.Variance = 1, x, 0
+		return
+	}
+	if b.Count >= *anomalyWarmup && b.Variance > 0 {
+		limit := *anomalyThreshold * b.stddev()
+		x = math.Max(b.Mean-limit, math.Min(b.Mean+limit, x))
+	}
+	b.Count++
+	// until warmed up, weigh cycles equally so the first doesn't dominate
+	alpha := math.Max(*anomalyAlpha, 1/float64(b.Count))
+	diff := x - b.Mean
+	incr := alpha * diff
+	b.Mean += incr
+	b.Variance = (1 - alpha) * (b.Variance + diff*incr)
+}
+
+// checkAnomaly scores a completed phase against the device's baseline,
+// recording an event if it's anomalous, and then learns from it.
+func (m *Monitor) checkAnomaly(now time.Time, on bool, d time.Duration) {
+	b, score, phase := &m.State.OffBaseline, &m.State.OffAnomalyScore, "off"
+	if on {
+		b, score, phase = &m.State.OnBaseline, &m.State.OnAnomalyScore, "on"
+	}
+	x := d.Seconds()
+	*score = b.score(x)
+	if math.Abs(*score) >= *anomalyThreshold {
+		m.State.AnomalyCount++
+		direction := "longer"
+		if *score < 0 {
+			direction = "shorter"
+		}
+		detail := fmt.Sprintf("%s phase of %s is %s than usual (%.1f standard deviations from %s)",
+			phase, d.Round(time.Second), direction, math.Abs(*score),
+			time.Duration(b.Mean*float64(time.Second)).Round(time.Second))
+		m.record(now, EventAnomaly, detail)
+		log.Printf("%s: anomaly: %s", m.ID(), detail)
+	}
+	b.update(x)
+}
@@ -0,0 +1,70 @@
+package collector
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/fffonion/tplink-plug-exporter/kasa"
+	"github.com/jonboulle/clockwork"
+)
+
+func TestBaseline(t *testing.T) {
+	var b Baseline
+	for i := 0; i < 100; i++ {
+		b.update(float64(600 + 60*(i%2*2-1)))
+	}
+	if math.Abs(b.Mean-600) > 10 {
+		t.Errorf("want mean near 600, got %v", b.Mean)
+	}
+	if s := b.stddev(); s < 40 || s > 80 {
+		t.Errorf("want stddev near 60, got %v", s)
+	}
+	if s := b.score(600); math.Abs(s) > 0.5 {
+		t.Errorf("want typical duration to score near 0, got %v", s)
+	}
+	if s := b.score(1200); s < *anomalyThreshold {
+		t.Errorf("want doubled duration to score above %v, got %v", *anomalyThreshold, s)
+	}
+
+	// an outlier is clamped, so doesn't drag the baseline far
+	mean := b.Mean
+	b.update(1e6)
+	if b.Mean-mean > 20 {
+		t.Errorf("want outlier clamped, mean moved from %v to %v", mean, b.Mean)
+	}
+}
+
+func TestAnomalyEvent(t *testing.T) {
+	now := mustParseTime(time.RFC3339, "2020-03-12T20:00:00.000000-00:00")
+	c := New([]string{"127.0.0.1"}, "", clockwork.NewFakeClockAt(now))
+	mon := c.MonitorAt("127.0.0.1")
+	clock := c.time.(clockwork.FakeClock)
+
+	phase := func(rt *kasa.GetRealtimeResponse, d time.Duration) {
+		mon.sample(clock.Now(), sysinfoResponse, rt)
+		clock.Advance(d)
+	}
+	for i := 0; i <= *anomalyWarmup; i++ {
+		phase(rtOn, 10*time.Minute+time.Duration(i%3)*time.Minute)
+		phase(rtOff, 20*time.Minute)
+	}
+	if mon.State.AnomalyCount != 0 {
+		t.Fatalf("want no anomalies while learning, got %d", mon.State.AnomalyCount)
+	}
+	phase(rtOn, 3*time.Hour)
+	phase(rtOff, 20*time.Minute)
+	if mon.State.AnomalyCount != 1 {
+		t.Fatalf("want 1 anomaly, got %d", mon.State.AnomalyCount)
+	}
+	if mon.State.OnAnomalyScore < *anomalyThreshold {
+		t.Errorf("want on anomaly score above %v, got %v", *anomalyThreshold, mon.State.OnAnomalyScore)
+	}
+	var found bool
+	for _, e := range mon.State.Events {
+		found = found || e.Type == EventAnomaly
+	}
+	if !found {
+		t.Errorf("want anomaly event in %+v", mon.State.Events)
+	}
+}
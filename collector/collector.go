@@ -1,12 +1,17 @@
 package collector
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/aqua/kasadutycycle/discovery"
 	"github.com/fffonion/tplink-plug-exporter/kasa"
 	"github.com/jonboulle/clockwork"
 )
@@ -15,8 +20,14 @@ var interval = flag.Duration("interval", 1*time.Minute, "sample interval")
 var checkpointInterval = flag.Duration("checkpoint-interval", 1*time.Minute, "checkpoint interval")
 var checkpointMaxAge = flag.Duration("checkpoint-max-age", 1*time.Hour, "ignore checkpoint samples older than this")
 var thresholdWatts = flag.Float64("threshold-watts", 5, "Wattage above which the unit is considered running")
+var minVoltage = flag.Float64("min-voltage", 90, "Supply voltage below which a metering plug is considered unpowered")
+var autoEnroll = flag.Bool("auto-enroll", false, "Discover energy-metering plugs on the LAN and monitor them automatically")
+var discoveryInterval = flag.Duration("discovery-interval", 10*time.Minute, "How often to re-run discovery when -auto-enroll is set")
+var offlineAfter = flag.Int("offline-after", 3, "Consecutive failed polls after which a device is considered offline")
+var rediscoverAfter = flag.Int("rediscover-after", 3, "Consecutive failed polls after which discovery is used to find a device's new address (0 to disable)")
 
 type MonitorState struct {
+	Addr            string `json:"addr"` // most recent known address
 	MAC             string `json:"mac"`
 	Model           string `json:"model"`
 	Alias           string `json:"alias"`
@@ -25,79 +36,244 @@ type MonitorState struct {
 	DeviceID        string `json:"device_id"`
 	SoftwareVersion string `json:"software_version"`
 	HardwareVersion string `json:"hardware_version"`
+	RelayState      bool   `json:"relay_state"`
+	Metering        bool   `json:"metering"` // has an energy meter; if not, duty follows the relay
 
 	Timestamp       time.Time       `json:"timestamp"`
 	CycleState      bool            `json:"state"`
+	Unpowered       bool            `json:"unpowered"` // relay off or no supply; cycle accounting paused
 	CycleCount      uint            `json:"cycle_count"`
 	CycleDurations  []time.Duration `json:"cycle_durations"` // awaiting export
+	CycleEnergies   []float64       `json:"cycle_energies"`  // kWh, awaiting export
 	LastOn          time.Time       `json:"last_on"`
 	LastOnDuration  time.Duration   `json:"last_on_duration"`
+	LastOnEnergyKwH float64         `json:"last_on_energy_kwh"`
+	LastOnPower     PowerStats      `json:"last_on_power"`
+	OnPhase         PhaseStats      `json:"on_phase"`
 	LastOff         time.Time       `json:"last_off"`
 	LastOffDuration time.Duration   `json:"last_off_duration"`
+	Transitions     []Transition    `json:"transitions,omitempty"` // recent, oldest first
+
+	// learned baselines of phase durations, and how far the most recent
+	// phases deviated from them
+	OnBaseline      Baseline `json:"on_baseline"`
+	OffBaseline     Baseline `json:"off_baseline"`
+	OnAnomalyScore  float64  `json:"on_anomaly_score"`
+	OffAnomalyScore float64  `json:"off_anomaly_score"`
+	AnomalyCount    uint     `json:"anomaly_count"`
+
+	// built-in alert rules, by name
+	Alerts map[string]Alert `json:"alerts,omitempty"`
+
+	// runtime protection
+	Tripped         bool      `json:"tripped"`
+	TrippedAt       time.Time `json:"tripped_at"`
+	ProtectionTrips uint      `json:"protection_trips"`
+
+	// load shedding
+	Shed      bool    `json:"shed"`
+	ShedWatts float64 `json:"shed_watts"` // draw when shed
 
 	// most recent samples
 	Power    float64 `json:"power"`
 	Voltage  float64 `json:"voltage"`
 	Current  float64 `json:"current"`
 	TotalKwH float64 `json:"total_kwh"`
+
+	Events []Event `json:"events,omitempty"` // recent history, oldest first
 }
 
 type Monitor struct {
 	Addr           string
 	interval       time.Duration
-	client         *kasa.KasaClient
+	client         plug
 	ThresholdWatts float64
 
 	lastSample *kasa.GetRealtimeResponse
+	failures   int     // consecutive failed polls
+	online     bool    // since last sampled, until -offline-after failures
+	outbox     []Event // awaiting EventSinks
 	State      MonitorState
 
 	time clockwork.Clock
 }
 
+// deviceID is the stable identity of a device: its device ID if it has
+// one, else its MAC address.
+func deviceID(deviceID, mac string) string {
+	if deviceID != "" {
+		return deviceID
+	}
+	return mac
+}
+
+// ID is the key under which the Monitor is held in Collector.Monitors: the
+// device's stable identity once known, else its address.
+func (m *Monitor) ID() string {
+	if id := deviceID(m.State.DeviceID, m.State.MAC); id != "" {
+		return id
+	}
+	return m.Addr
+}
+
+// Online is whether the device has answered since it was last declared
+// offline.
+func (m *Monitor) Online() bool {
+	return m.online
+}
+
+func (m *Monitor) setAddr(addr string) {
+	m.Addr = addr
+	m.State.Addr = addr
+	m.client = newKasaPlug(addr)
+}
+
+// sample updates m's state from a poll of the device.  rt is nil for
+// devices without an energy meter, whose duty state follows their relay.
 func (m *Monitor) sample(now time.Time, sys *kasa.GetSysInfoResponse, rt *kasa.GetRealtimeResponse) {
+	first := m.State.Timestamp.IsZero() && m.lastSample == nil
+	prev, prevPower := m.State.Timestamp, m.State.Power
+	m.failures = 0
+	m.State.Addr = m.Addr
 	m.State.Timestamp = now
-	log.Printf("sampling %s (%q), %fw at %fa@%fv",
-		sys.Model, sys.Alias,
-		rt.Power, rt.Current, rt.Voltage)
+	defer m.recordSample(now)
 	m.State.MAC, m.State.Model, m.State.Alias, m.State.Feature = sys.MAC, sys.Model, sys.Alias, sys.Feature
 	m.State.DeviceID, m.State.SoftwareVersion, m.State.HardwareVersion = sys.DeviceID, sys.SoftwareVersion, sys.HardwareVersion
 	m.State.RSSI = sys.RSSI
+	m.State.RelayState = sys.RelayState != 0
+	m.State.Metering = rt != nil
+	// a relay switched back on at the plug or from the Kasa app, rather
+	// than through SetRelay, ends a protection trip or load shedding
+	if m.State.RelayState && m.State.Tripped {
+		m.State.Tripped, m.State.TrippedAt = false, time.Time{}
+		m.record(now, EventProtectionReset, "relay switched on outside the API")
+		log.Printf("%s: relay switched on; protection reset", m.ID())
+	}
+	if m.State.RelayState && m.State.Shed {
+		m.State.Shed = false
+		m.record(now, EventLoadRestore, "relay switched on outside the API")
+		log.Printf("%s: relay switched on; no longer shed", m.ID())
+	}
+	if !m.online {
+		m.online = true
+		m.record(now, EventOnline, m.Addr)
+	}
 
-	m.State.Power, m.State.Voltage, m.State.Current, m.State.TotalKwH = rt.Power, rt.Voltage, rt.Current, rt.Total
+	var on bool
+	if rt != nil {
+		log.Printf("sampling %s (%q), %fw at %fa@%fv",
+			sys.Model, sys.Alias,
+			rt.Power, rt.Current, rt.Voltage)
+		m.State.Power, m.State.Voltage, m.State.Current, m.State.TotalKwH = rt.Power, rt.Voltage, rt.Current, rt.Total
+		on = rt.Power >= m.ThresholdWatts
+		if m.State.CycleState && !m.State.Unpowered {
+			m.accumulate(now, prev, prevPower)
+		}
+	} else {
+		log.Printf("sampling %s (%q), relay %v", sys.Model, sys.Alias, m.State.RelayState)
+		on = m.State.RelayState
+	}
 
-	if m.State.Timestamp.IsZero() && m.lastSample == nil {
+	// A metering plug switched off (or losing supply) reads 0w, which isn't
+	// the appliance resting; don't account it as such.
+	if rt != nil && (!m.State.RelayState || rt.Voltage < *minVoltage) {
+		if !m.State.Unpowered {
+			m.State.Unpowered = true
+			m.State.CycleState = false
+			m.transition(now, false)
+			m.State.Transitions[len(m.State.Transitions)-1].Unpowered = true
+			m.record(now, EventUnpowered, fmt.Sprintf("relay %v, %.1fv", m.State.RelayState, rt.Voltage))
+			log.Printf("unpowered (relay %v, %fv); pausing cycle accounting", m.State.RelayState, rt.Voltage)
+		}
+		return
+	}
+	restored := false
+	if m.State.Unpowered {
+		// the interrupted phase is incomplete; start afresh
+		m.State.Unpowered = false
+		first, restored = true, true
+		m.record(now, EventPowered, "")
+		log.Printf("powered again; resuming cycle accounting")
+	}
+
+	if first {
 		m.lastSample = rt
-		if m.State.CycleState = rt.Power >= m.ThresholdWatts; m.State.CycleState {
+		if m.State.CycleState = on; m.State.CycleState {
 			m.State.LastOn = now
+			m.startPhase()
 			log.Printf("no prior state, starting at %v as of %s", m.State.CycleState, m.State.LastOn)
 		} else {
 			m.State.LastOff = now
 			log.Printf("no prior state, starting at %v as of %s", m.State.CycleState, m.State.LastOff)
 		}
-	} else if rt.Power >= m.ThresholdWatts && !m.State.CycleState {
+		m.transition(now, m.State.CycleState)
+		if restored {
+			m.State.Transitions[len(m.State.Transitions)-1].Restored = true
+			// an appliance running once power returns has switched on,
+			// though there's no OFF phase to report
+			if m.State.CycleState {
+				m.add(Event{Time: now, Type: EventOn, Power: m.State.Power, Detail: "restored after power loss"})
+			}
+		}
+	} else if on && !m.State.CycleState {
 		m.State.CycleState = true
 		m.State.LastOn = now
+		m.startPhase()
 		if !m.State.LastOff.IsZero() {
 			m.State.LastOffDuration = m.State.LastOn.Sub(m.State.LastOff)
 		}
-		log.Printf("low-to-high transition: %fw; was off %s", rt.Power, m.State.LastOffDuration)
-	} else if rt.Power < m.ThresholdWatts && m.State.CycleState {
+		m.transition(now, true)
+		m.recordTransition(now, EventOn, m.State.LastOff)
+		if !m.State.LastOff.IsZero() {
+			m.checkAnomaly(now, false, m.State.LastOffDuration)
+		}
+		log.Printf("low-to-high transition: %fw; was off %s", m.State.Power, m.State.LastOffDuration)
+	} else if on && m.State.CycleState {
+		if m.State.Metering {
+			m.observe()
+		}
+	} else if !on && m.State.CycleState {
 		m.State.CycleState = false
 		m.State.LastOff = now
 		if !m.State.LastOn.IsZero() {
 			m.State.LastOnDuration = m.State.LastOff.Sub(m.State.LastOn)
 			m.State.CycleDurations = append(m.State.CycleDurations, m.State.LastOnDuration)
 			m.State.CycleCount++
+			if m.State.Metering {
+				m.State.LastOnEnergyKwH = m.State.OnPhase.energy(m.State.TotalKwH)
+				m.State.LastOnPower = m.State.OnPhase.power()
+				m.State.CycleEnergies = append(m.State.CycleEnergies, m.State.LastOnEnergyKwH)
+			}
 		}
-		log.Printf("high-to-low transition: %fw; was on %s", rt.Power, m.State.LastOnDuration)
+		m.transition(now, false)
+		m.recordTransition(now, EventOff, m.State.LastOn)
+		if !m.State.LastOn.IsZero() {
+			m.checkAnomaly(now, true, m.State.LastOnDuration)
+		}
+		log.Printf("high-to-low transition: %fw; was on %s", m.State.Power, m.State.LastOnDuration)
 	}
 }
 
+// Collector owns the set of Monitors.  The embedded Mutex guards Monitors
+// and their State; hold it while reading either from another goroutine.
 type Collector struct {
-	shutdown       chan bool
+	sync.Mutex
+
 	checkpointFile string
 	time           clockwork.Clock
 
+	// checkpointed states not (yet) claimed by a Monitor, by device ID
+	pending map[string]MonitorState
+	config  map[string]DeviceConfig
+
+	lastLoadShed time.Time
+	sinks        []EventSink
+	subscribers  []*Subscription
+	delivery     sync.Mutex         // held by flush
+	cancel       context.CancelFunc // of Run
+
+	// Monitors, keyed by device ID (or by address until the device at that
+	// address has been identified).
 	Monitors map[string]*Monitor
 }
 
@@ -105,42 +281,171 @@ func New(addrs []string, checkpointFile string, clock clockwork.Clock) *Collecto
 	c := &Collector{
 		checkpointFile: checkpointFile,
 		Monitors:       map[string]*Monitor{},
+		pending:        map[string]MonitorState{},
+		config:         map[string]DeviceConfig{},
 		time:           clock,
 	}
-	cpStates := map[string]MonitorState{}
+	if *deviceConfigFile != "" {
+		cfg, err := loadDeviceConfig(*deviceConfigFile)
+		if err != nil {
+			log.Fatalf("error loading device config: %v", err)
+		}
+		c.config = cfg
+	}
 	if checkpointFile != "" {
 		if s, err := c.loadStateCheckpoint(checkpointFile); err != nil {
 			log.Printf("error loading checkpoint, starting fresh")
 		} else {
 			log.Printf("got checkpoint on %d device(s)", len(s))
-			cpStates = s
+			for k, st := range s {
+				if st.Addr == "" {
+					// checkpoints predating device identity are keyed by address
+					st.Addr = k
+				}
+				id := deviceID(st.DeviceID, st.MAC)
+				if id == "" {
+					id = st.Addr
+				}
+				c.pending[id] = st
+			}
 		}
 	}
 	for _, a := range addrs {
-		c.Monitors[a] = &Monitor{
-			Addr:           a,
-			interval:       *interval,
-			ThresholdWatts: *thresholdWatts,
-			client: kasa.New(&kasa.KasaClientConfig{
-				Host: a,
-			}),
-			time: c.time,
-		}
-		if s, ok := cpStates[a]; ok {
-			if c.time.Now().Sub(s.Timestamp) <= *checkpointMaxAge {
-				c.Monitors[a].State = s
-				log.Printf("restoring checkpointed state of %s", a)
-			} else {
-				log.Printf("checkpointed state of %s is too old (%s vs limit of %s), ignoring",
-					a, c.time.Now().Sub(s.Timestamp), *checkpointMaxAge)
+		m := c.addMonitor(a)
+		// Provisionally restore whatever was last seen at this address; if a
+		// different device answers there, identify() sorts it out.
+		for id, st := range c.pending {
+			if st.Addr == a {
+				c.restore(m, id)
+				break
 			}
-		} else {
+		}
+		if m.State.Timestamp.IsZero() {
 			log.Printf("no prior checkpointed state of %s", a)
 		}
 	}
 	return c
 }
 
+// MonitorAt returns the Monitor polling addr, or nil.
+func (c *Collector) MonitorAt(addr string) *Monitor {
+	for _, m := range c.Monitors {
+		if m.Addr == addr {
+			return m
+		}
+	}
+	return nil
+}
+
+func (c *Collector) addMonitor(addr string) *Monitor {
+	m := &Monitor{
+		Addr:           addr,
+		interval:       *interval,
+		ThresholdWatts: *thresholdWatts,
+		client:         newKasaPlug(addr),
+		time:           c.time,
+	}
+	c.Monitors[addr] = m
+	return m
+}
+
+func (c *Collector) removeMonitor(m *Monitor) {
+	for k, v := range c.Monitors {
+		if v == m {
+			delete(c.Monitors, k)
+		}
+	}
+}
+
+// rekey moves m to its current ID in Monitors.
+func (c *Collector) rekey(m *Monitor) {
+	c.removeMonitor(m)
+	c.Monitors[m.ID()] = m
+}
+
+// restore adopts the pending checkpointed state of device id into m, if
+// it is recent enough.
+func (c *Collector) restore(m *Monitor, id string) {
+	s, ok := c.pending[id]
+	if !ok {
+		return
+	}
+	delete(c.pending, id)
+	if age := c.time.Now().Sub(s.Timestamp); age > *checkpointMaxAge {
+		log.Printf("checkpointed state of %s is too old (%s vs limit of %s), ignoring",
+			id, age, *checkpointMaxAge)
+		return
+	}
+	log.Printf("restoring checkpointed state of %s (last seen at %s) at %s", id, s.Addr, m.Addr)
+	m.State = s
+	m.State.Addr = m.Addr
+	c.rekey(m)
+}
+
+// identify reconciles a freshly-polled Monitor with the identity reported
+// by the device at its address.  The device may be new to us, may have
+// checkpointed history waiting for it, may be a different device than the
+// one whose history was provisionally restored at this address, or may be
+// one we already monitor which has moved here.  It returns the Monitor
+// which should take samples from the device.
+func (c *Collector) identify(m *Monitor, sys *kasa.GetSysInfoResponse) *Monitor {
+	id := deviceID(sys.DeviceID, sys.MAC)
+	if id == "" || id == deviceID(m.State.DeviceID, m.State.MAC) && c.Monitors[id] == m {
+		return m
+	}
+	if prior := deviceID(m.State.DeviceID, m.State.MAC); prior != "" && prior != id {
+		log.Printf("%s is now %s, not %s; setting aside prior state", m.Addr, id, prior)
+		c.pending[prior] = m.State
+		m.State = MonitorState{Addr: m.Addr}
+		m.lastSample = nil
+	}
+	if other, ok := c.Monitors[id]; ok && other != m {
+		log.Printf("%s moved from %s to %s", id, other.Addr, m.Addr)
+		c.removeMonitor(m)
+		other.setAddr(m.Addr)
+		return other
+	}
+	c.restore(m, id)
+	m.State.DeviceID, m.State.MAC = sys.DeviceID, sys.MAC
+	c.rekey(m)
+	return m
+}
+
+// enroll reconciles discovered devices with the monitored set: devices we
+// already monitor have their address updated if it has changed, and (with
+// -auto-enroll) new energy-metering devices get a Monitor.
+func (c *Collector) enroll(devices []discovery.Device) {
+	c.Lock()
+	defer c.Unlock()
+	for _, d := range devices {
+		id := deviceID(d.SysInfo.DeviceID, d.SysInfo.MAC)
+		if m, ok := c.Monitors[id]; ok && id != "" {
+			if m.Addr != d.Addr {
+				log.Printf("discovered %s has moved from %s to %s", id, m.Addr, d.Addr)
+				if stale := c.MonitorAt(d.Addr); stale != nil && stale != m {
+					c.removeMonitor(stale)
+				}
+				m.setAddr(d.Addr)
+			}
+			continue
+		}
+		if !*autoEnroll || !d.EmeterSupported() || c.MonitorAt(d.Addr) != nil {
+			continue
+		}
+		log.Printf("enrolling discovered %s (%q) at %s", d.SysInfo.Model, d.SysInfo.Alias, d.Addr)
+		c.identify(c.addMonitor(d.Addr), d.SysInfo)
+	}
+}
+
+func (c *Collector) discover() {
+	devices, err := discovery.Discover()
+	if err != nil {
+		log.Printf("error running discovery: %v", err)
+		return
+	}
+	c.enroll(devices)
+}
+
 func (c *Collector) loadStateCheckpoint(fn string) (map[string]MonitorState, error) {
 	f, err := os.Open(fn)
 	if err != nil {
@@ -161,9 +466,17 @@ func (c *Collector) saveStateCheckpoint(fn string) error {
 		return nil
 	}
 	states := map[string]MonitorState{}
-	for name, m := range c.Monitors {
-		states[name] = m.State
+	c.Lock()
+	for id, st := range c.pending {
+		states[id] = st
+	}
+	for id, m := range c.Monitors {
+		if m.State.Timestamp.IsZero() {
+			continue
+		}
+		states[id] = m.State
 	}
+	c.Unlock()
 	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		log.Printf("error opening checkpoint file %s: %v", fn, err)
@@ -174,40 +487,136 @@ func (c *Collector) saveStateCheckpoint(fn string) error {
 	return json.NewEncoder(f).Encode(&states)
 }
 
+// Now is the time according to the Collector's clock.
+func (c *Collector) Now() time.Time {
+	return c.time.Now()
+}
+
+// Shutdown stops Run.
 func (c *Collector) Shutdown() {
-	c.shutdown <- true
+	c.Lock()
+	cancel := c.cancel
+	c.Unlock()
+	if cancel != nil {
+		cancel()
+	}
 }
 
 type cpEvent bool
 
-func (c *Collector) Run(shutdown chan bool) {
+// poll samples a single device.
+func (c *Collector) poll(m *Monitor) {
+	sysinfo, err := m.client.SysInfo()
+	if err != nil {
+		log.Println("error collecting", m.Addr, ":", err)
+		c.failed(m, err)
+		return
+	}
+	// log.Printf("sysinfo %v", sysinfo)
+	var rt *kasa.GetRealtimeResponse
+	if strings.Contains(sysinfo.Feature, "ENE") {
+		if rt, err = m.client.Realtime(); err != nil {
+			log.Println("error collecting", m.Addr, ":", err)
+			c.failed(m, err)
+			return
+		}
+	}
+	c.Lock()
+	m = c.identify(m, sysinfo)
+	now := c.time.Now()
+	m.sample(now, sysinfo, rt)
+	m.trimTransitions(now.Add(-c.transitionWindow(m)))
+	c.Unlock()
+	c.protect(m)
+	c.flush()
+}
+
+// maxRediscoverBackoff bounds the backoff between rediscovery attempts, in
+// multiples of -rediscover-after polls.
+const maxRediscoverBackoff = 32
+
+// rediscoverDue is whether, after failures consecutive failed polls, the
+// device should be looked for elsewhere on the network: after `after`
+// failures, and again after twice, four times as many and so on (discovery
+// being a UDP broadcast which may go unanswered), and thereafter every
+// maxRediscoverBackoff times as many.
+func rediscoverDue(failures, after int) bool {
+	if after <= 0 || failures < after || failures%after != 0 {
+		return false
+	}
+	n := failures / after
+	return n&(n-1) == 0 || n%maxRediscoverBackoff == 0
+}
+
+// failed notes a failed poll of m, marking it offline after -offline-after
+// polls, and looking for the device elsewhere on the network once it has
+// been unreachable for -rediscover-after polls (retrying with backoff).
+func (c *Collector) failed(m *Monitor, err error) {
+	c.Lock()
+	m.failures++
+	id, addr := m.ID(), m.Addr
+	rediscover := rediscoverDue(m.failures, *rediscoverAfter) && id != addr
+	if m.online && m.failures >= *offlineAfter {
+		m.online = false
+		m.record(c.time.Now(), EventOffline, err.Error())
+		log.Printf("%s offline after %d failed polls", id, m.failures)
+	}
+	c.Unlock()
+	c.flush()
+	if rediscover {
+		log.Printf("%s unreachable at %s, rediscovering", id, addr)
+		c.discover()
+	}
+}
+
+// Run polls the devices every -interval, checkpointing and discovering
+// devices as configured, until ctx is done or Shutdown is called.  The
+// state is checkpointed once more before it returns.
+func (c *Collector) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c.Lock()
+	c.cancel = cancel
+	c.Unlock()
 	cpTicker := time.NewTicker(*checkpointInterval)
+	defer cpTicker.Stop()
 	intervalTicker := time.NewTicker(*interval)
+	defer intervalTicker.Stop()
+	var discoveryC <-chan time.Time
+	if *autoEnroll {
+		c.discover()
+		discoveryTicker := time.NewTicker(*discoveryInterval)
+		defer discoveryTicker.Stop()
+		discoveryC = discoveryTicker.C
+	}
 	for {
 		select {
-		case <-shutdown:
+		case <-ctx.Done():
 			log.Printf("kasadutycycle: shutdown")
-			return
+			if c.checkpointFile != "" {
+				c.saveStateCheckpoint(c.checkpointFile)
+			}
+			return ctx.Err()
 		case <-cpTicker.C:
 			log.Printf("checkpoint tick")
 			if c.checkpointFile != "" {
 				c.saveStateCheckpoint(c.checkpointFile)
 			}
+		case <-discoveryC:
+			c.discover()
 		case <-intervalTicker.C:
+			c.Lock()
+			monitors := make([]*Monitor, 0, len(c.Monitors))
 			for _, m := range c.Monitors {
-				sys := m.client.SystemService(nil)
-				if sysinfo, err := sys.GetSysInfo(); err != nil {
-					log.Println("error collecting", m.Addr, ":", err)
-				} else {
-					// log.Printf("sysinfo %v", sysinfo)
-					emeter := m.client.EmeterService(nil)
-					if rt, err := emeter.GetRealtime(); err != nil {
-						log.Println("error collecting", m.Addr, ":", err)
-					} else {
-						m.sample(c.time.Now(), sysinfo, rt)
-					}
-				}
+				monitors = append(monitors, m)
+			}
+			c.Unlock()
+			for _, m := range monitors {
+				c.poll(m)
 			}
+			c.shedLoad()
+			c.checkAlerts()
+			c.flush()
 		}
 	}
 }
@@ -1,9 +1,11 @@
 package collector
 
 import (
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/aqua/kasadutycycle/discovery"
 	"github.com/fffonion/tplink-plug-exporter/kasa"
 	"github.com/jonboulle/clockwork"
 )
@@ -25,9 +27,9 @@ func TestSetupNoCheckpoint(t *testing.T) {
 	if len(c.Monitors) != 1 {
 		t.Errorf("want 1 monitor, got %d", len(c.Monitors))
 	}
-	if !c.Monitors["127.0.0.1"].State.Timestamp.IsZero() {
+	if !c.MonitorAt("127.0.0.1").State.Timestamp.IsZero() {
 		t.Errorf("want 1 monitor with no state, got a timestamp; state=%v",
-			c.Monitors["127.0.0.1"].State)
+			c.MonitorAt("127.0.0.1").State)
 	}
 }
 
@@ -43,9 +45,9 @@ func TestSetupCurrentCheckpoint(t *testing.T) {
 	if len(c.Monitors) != 1 {
 		t.Errorf("want 1 monitor, got %d", len(c.Monitors))
 	}
-	if c.Monitors["127.0.0.1"].State.Timestamp.IsZero() {
+	if c.MonitorAt("127.0.0.1").State.Timestamp.IsZero() {
 		t.Errorf("want 1 monitor with no state, got a timestamp, state=%v",
-			c.Monitors["127.0.0.1"].State)
+			c.MonitorAt("127.0.0.1").State)
 	}
 }
 
@@ -61,17 +63,99 @@ func TestSetupOldCheckpoint(t *testing.T) {
 	if len(c.Monitors) != 1 {
 		t.Errorf("want 1 monitor, got %d", len(c.Monitors))
 	}
-	if !c.Monitors["127.0.0.1"].State.Timestamp.IsZero() {
+	if !c.MonitorAt("127.0.0.1").State.Timestamp.IsZero() {
 		t.Errorf("want 1 monitor with no state, got a timestamp")
 	}
 }
 
+func TestEnroll(t *testing.T) {
+	c := New([]string{"127.0.0.1"}, "", clockwork.NewFakeClock())
+	*autoEnroll = true
+	defer func() { *autoEnroll = false }()
+	c.enroll([]discovery.Device{
+		{Addr: "127.0.0.1", SysInfo: &kasa.GetSysInfoResponse{Feature: "TIM:ENE"}},
+		{Addr: "127.0.0.2", SysInfo: &kasa.GetSysInfoResponse{Feature: "TIM:ENE", DeviceID: "0002"}},
+		{Addr: "127.0.0.3", SysInfo: &kasa.GetSysInfoResponse{Feature: "TIM", DeviceID: "0003"}},
+	})
+	if len(c.Monitors) != 2 {
+		t.Errorf("want 2 monitors, got %d", len(c.Monitors))
+	}
+	if _, ok := c.Monitors["0002"]; !ok {
+		t.Errorf("want discovered metering plug enrolled, got %v", c.Monitors)
+	}
+	if c.MonitorAt("127.0.0.3") != nil {
+		t.Errorf("want non-metering plug skipped, got %v", c.Monitors)
+	}
+}
+
+func TestRediscoverDue(t *testing.T) {
+	var due []int
+	for n := 1; n <= 400; n++ {
+		if rediscoverDue(n, 3) {
+			due = append(due, n)
+		}
+	}
+	want := []int{3, 6, 12, 24, 48, 96, 192, 288, 384}
+	if !slices.Equal(due, want) {
+		t.Errorf("want rediscovery after %v failures, got %v", want, due)
+	}
+	if rediscoverDue(3, 0) {
+		t.Errorf("want rediscovery disabled")
+	}
+}
+
+func TestIdentifyMovedDevice(t *testing.T) {
+	now := mustParseTime(time.RFC3339, "2024-03-12T21:25:30.000000-00:00")
+	// the checkpointed device was last seen at 127.0.0.1, but has moved
+	c := New([]string{"127.0.0.2"},
+		"testdata/current-checkpoint.json",
+		clockwork.NewFakeClockAt(now))
+	m := c.MonitorAt("127.0.0.2")
+	if !m.State.Timestamp.IsZero() {
+		t.Errorf("want no state before identification, got %v", m.State)
+	}
+	const id = "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"
+	m = c.identify(m, &kasa.GetSysInfoResponse{DeviceID: id, MAC: "aa:bb:cc:dd:ee:ff"})
+	if c.Monitors[id] != m {
+		t.Errorf("want monitor keyed by %s, got %v", id, c.Monitors)
+	}
+	if m.State.Alias != "Pluggy McPlugface" {
+		t.Errorf("want checkpointed state restored, got %v", m.State)
+	}
+
+	// and now moves again, to an address we were already polling
+	other := c.addMonitor("127.0.0.3")
+	if got := c.identify(other, &kasa.GetSysInfoResponse{DeviceID: id}); got != m {
+		t.Errorf("want existing monitor to take over, got %v", got)
+	}
+	if m.Addr != "127.0.0.3" || len(c.Monitors) != 1 {
+		t.Errorf("want single monitor at 127.0.0.3, got %s, %v", m.Addr, c.Monitors)
+	}
+}
+
+func TestIdentifyReplacedDevice(t *testing.T) {
+	now := mustParseTime(time.RFC3339, "2024-03-12T21:25:30.000000-00:00")
+	c := New([]string{"127.0.0.1"},
+		"testdata/current-checkpoint.json",
+		clockwork.NewFakeClockAt(now))
+	m := c.MonitorAt("127.0.0.1")
+	// a different plug has taken over the checkpointed device's address
+	m = c.identify(m, &kasa.GetSysInfoResponse{DeviceID: "EEEE"})
+	if m.State.Alias != "" || c.Monitors["EEEE"] != m {
+		t.Errorf("want fresh state for new device, got %v", m.State)
+	}
+	if _, ok := c.pending["FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"]; !ok {
+		t.Errorf("want prior device's state kept pending, got %v", c.pending)
+	}
+}
+
 var (
 	sysinfoResponse = &kasa.GetSysInfoResponse{
 		MAC:             "aa:bb:cc:dd:ee",
 		Model:           "model",
 		Alias:           "alias",
 		Feature:         "feature",
+		RelayState:      1,
 		RSSI:            42,
 		LEDOff:          1,
 		OnTime:          1234,
@@ -203,3 +287,153 @@ func TestSampleIterations(t *testing.T) {
 		}
 	}
 }
+
+func TestSampleRelayMode(t *testing.T) {
+	now := mustParseTime(time.RFC3339, "2020-03-12T20:00:00.000000-00:00")
+	c := New([]string{"127.0.0.1"}, "", clockwork.NewFakeClockAt(now))
+	mon := c.MonitorAt("127.0.0.1")
+	relayOn, relayOff := *sysinfoResponse, *sysinfoResponse
+	relayOn.RelayState, relayOff.RelayState = 1, 0
+	for i, sys := range []*kasa.GetSysInfoResponse{&relayOff, &relayOn, &relayOn, &relayOff} {
+		mon.sample(c.time.Now(), sys, nil)
+		if want := sys.RelayState != 0; mon.State.CycleState != want {
+			t.Errorf("at step %d want state %v, got %v", i, want, mon.State.CycleState)
+		}
+		c.time.(clockwork.FakeClock).Advance(*interval)
+	}
+	if mon.State.Metering {
+		t.Errorf("want non-metering state")
+	}
+	if mon.State.CycleCount != 1 || mon.State.LastOnDuration != 2**interval {
+		t.Errorf("want 1 cycle of %s, got %d of %s",
+			2**interval, mon.State.CycleCount, mon.State.LastOnDuration)
+	}
+}
+
+func TestSampleUnpowered(t *testing.T) {
+	now := mustParseTime(time.RFC3339, "2020-03-12T20:00:00.000000-00:00")
+	c := New([]string{"127.0.0.1"}, "", clockwork.NewFakeClockAt(now))
+	mon := c.MonitorAt("127.0.0.1")
+	switchedOff := *sysinfoResponse
+	switchedOff.RelayState = 0
+	brownout := *rtOff
+	brownout.Voltage = 40
+	steps := []struct {
+		sys       *kasa.GetSysInfoResponse
+		rt        *kasa.GetRealtimeResponse
+		state     bool
+		unpowered bool
+	}{
+		{sysinfoResponse, rtOff, false, false},
+		{sysinfoResponse, rtOn, true, false},
+		{&switchedOff, rtOff, false, true},
+		{&switchedOff, rtOff, false, true},
+		{sysinfoResponse, rtOn, true, false},
+		{sysinfoResponse, &brownout, false, true},
+		{sysinfoResponse, rtOff, false, false},
+	}
+	for i, st := range steps {
+		mon.sample(c.time.Now(), st.sys, st.rt)
+		if mon.State.CycleState != st.state || mon.State.Unpowered != st.unpowered {
+			t.Errorf("at step %d want state %v unpowered %v, got %v, %v",
+				i, st.state, st.unpowered, mon.State.CycleState, mon.State.Unpowered)
+		}
+		c.time.(clockwork.FakeClock).Advance(*interval)
+	}
+	if mon.State.CycleCount != 0 {
+		t.Errorf("want interrupted ON phases not counted as cycles, got %d", mon.State.CycleCount)
+	}
+	var restored []Transition
+	for _, tr := range mon.State.Transitions {
+		if tr.Restored {
+			restored = append(restored, tr)
+		}
+	}
+	if len(restored) != 2 || !restored[0].On || restored[1].On {
+		t.Errorf("want restores to on then off marked, got %v", mon.State.Transitions)
+	}
+	var ons []Event
+	for _, e := range mon.State.Events {
+		if e.Type == EventOn {
+			ons = append(ons, e)
+		}
+	}
+	if len(ons) != 2 || ons[1].Detail != "restored after power loss" || ons[1].Cycle != nil {
+		t.Errorf("want ON after power loss recorded without a cycle, got %v", ons)
+	}
+	frac, observed := mon.State.Duty(c.time.Now(), time.Hour)
+	if observed != 4**interval || frac != 0.5 {
+		t.Errorf("want 50%% duty over %s powered, got %f over %s", 4**interval, frac, observed)
+	}
+}
+
+func TestCycleEnergy(t *testing.T) {
+	cases := []struct {
+		desc     string
+		kwhStep  float64 // counter increase per minute while on
+		gap      bool    // of an hour, before the sixth sample
+		wantLow  float64
+		wantHigh float64
+	}{
+		// 10m at 90w is 0.015kWh
+		{"fine counter", 0.0015, false, 0.0149, 0.0151},
+		// the counter doesn't move, so power is integrated instead: 9m at
+		// 90w, and a last minute in which power falls to 0.05w
+		{"coarse counter", 0, false, 0.0142, 0.0143},
+		// as above, less the minute before the gap, across which power
+		// isn't integrated
+		{"coarse counter with gap", 0, true, 0.0127, 0.0128},
+	}
+	for _, td := range cases {
+		now := mustParseTime(time.RFC3339, "2020-03-12T20:00:00.000000-00:00")
+		c := New([]string{"127.0.0.1"}, "", clockwork.NewFakeClockAt(now))
+		mon := c.MonitorAt("127.0.0.1")
+		for i := 0; i < 12; i++ {
+			rt := *rtOn
+			if i == 0 || i == 11 {
+				rt = *rtOff
+			}
+			rt.Total = 1
+			if td.gap && i == 5 {
+				c.time.(clockwork.FakeClock).Advance(time.Hour)
+			}
+			if i > 1 {
+				rt.Total += float64(i-1) * td.kwhStep
+			}
+			mon.sample(c.time.Now(), sysinfoResponse, &rt)
+			c.time.(clockwork.FakeClock).Advance(time.Minute)
+		}
+		if mon.State.CycleCount != 1 {
+			t.Fatalf("%s: want 1 cycle, got %d", td.desc, mon.State.CycleCount)
+		}
+		if e := mon.State.LastOnEnergyKwH; e < td.wantLow || e > td.wantHigh {
+			t.Errorf("%s: want energy %f-%f, got %f", td.desc, td.wantLow, td.wantHigh, e)
+		}
+		if len(mon.State.CycleEnergies) != 1 {
+			t.Errorf("%s: want energy awaiting export, got %v", td.desc, mon.State.CycleEnergies)
+		}
+	}
+}
+
+func TestCyclePowerStats(t *testing.T) {
+	now := mustParseTime(time.RFC3339, "2020-03-12T20:00:00.000000-00:00")
+	c := New([]string{"127.0.0.1"}, "", clockwork.NewFakeClockAt(now))
+	mon := c.MonitorAt("127.0.0.1")
+	for _, p := range []float64{0.05, 150, 90, 95, 85, 0.05} {
+		rt := *rtOn
+		rt.Power = p
+		mon.sample(c.time.Now(), sysinfoResponse, &rt)
+		c.time.(clockwork.FakeClock).Advance(time.Minute)
+	}
+	want := PowerStats{PeakWatts: 150, MeanWatts: 105, MinWatts: 85, InrushWatts: 150}
+	if mon.State.LastOnPower != want {
+		t.Errorf("want %+v, got %+v", want, mon.State.LastOnPower)
+	}
+	e := mon.State.Events[len(mon.State.Events)-1]
+	if e.Type != EventOff || e.Cycle == nil || e.Cycle.Power == nil || *e.Cycle.Power != want {
+		t.Errorf("want power stats attached to completed cycle, got %+v", e)
+	}
+	if e.DurationSeconds != 240 || e.Cycle.DurationSeconds != 240 {
+		t.Errorf("want 240s ON phase, got %+v", e)
+	}
+}
@@ -0,0 +1,83 @@
+package collector
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var deviceConfigFile = flag.String("device-config", "", "JSON file of per-device settings, keyed by device ID, address or alias")
+
+// Duration is a time.Duration which marshals to and from JSON as a string
+// such as "90m".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Protection limits how long a device may run.  When tripped, the device's
+// relay is switched off, and back on after Cooldown (if set).
+type Protection struct {
+	MaxOnTime  Duration `json:"max_on_time,omitempty"`
+	MaxDuty    float64  `json:"max_duty,omitempty"` // fraction of DutyWindow, 0-1
+	DutyWindow Duration `json:"duty_window,omitempty"`
+	Cooldown   Duration `json:"cooldown,omitempty"`
+}
+
+// DeviceConfig holds settings for a single device.
+type DeviceConfig struct {
+	Protection *Protection `json:"protection,omitempty"`
+	LoadShed   *LoadShed   `json:"load_shed,omitempty"`
+	Alerts     *AlertRules `json:"alerts,omitempty"`
+}
+
+func loadDeviceConfig(fn string) (map[string]DeviceConfig, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	cfg := map[string]DeviceConfig{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", fn, err)
+	}
+	for k, dc := range cfg {
+		if p := dc.Protection; p != nil && p.MaxDuty > 0 && p.DutyWindow <= 0 {
+			return nil, fmt.Errorf("%s: %s: max_duty requires duty_window", fn, k)
+		}
+	}
+	return cfg, nil
+}
+
+// deviceConfig returns the configuration for m, matched by device ID,
+// address or alias in that order.
+func (c *Collector) deviceConfig(m *Monitor) DeviceConfig {
+	if dc, ok := c.config[m.ID()]; ok {
+		return dc
+	}
+	if dc, ok := c.config[m.Addr]; ok {
+		return dc
+	}
+	for k, dc := range c.config {
+		if m.State.Alias != "" && strings.EqualFold(k, m.State.Alias) {
+			return dc
+		}
+	}
+	return DeviceConfig{}
+}
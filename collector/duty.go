@@ -0,0 +1,114 @@
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type durationList []time.Duration
+
+func (l *durationList) String() string {
+	var s []string
+	for _, d := range *l {
+		s = append(s, d.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *durationList) Set(v string) error {
+	var ds durationList
+	for _, f := range strings.Split(v, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(f))
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("window must be positive, got %s", d)
+		}
+		ds = append(ds, d)
+	}
+	*l = ds
+	return nil
+}
+
+var dutyWindows = durationList{time.Hour, 6 * time.Hour, 24 * time.Hour}
+
+func init() {
+	flag.Var(&dutyWindows, "duty-windows", "Comma-separated windows over which duty cycle percentages are computed")
+}
+
+// DutyWindows returns the windows over which duty cycles are reported.
+func DutyWindows() []time.Duration {
+	return append([]time.Duration(nil), dutyWindows...)
+}
+
+// Transition is a change in a device's duty state.  Unpowered marks the
+// change to off as power is lost, and Restored the first once it returns.
+type Transition struct {
+	Time      time.Time `json:"time"`
+	On        bool      `json:"on"`
+	Unpowered bool      `json:"unpowered,omitempty"`
+	Restored  bool      `json:"restored,omitempty"`
+}
+
+func (m *Monitor) transition(now time.Time, on bool) {
+	m.State.Transitions = append(m.State.Transitions, Transition{Time: now, On: on})
+}
+
+// transitionWindow is how much transition history m needs to retain.
+func (c *Collector) transitionWindow(m *Monitor) time.Duration {
+	var w time.Duration
+	for _, d := range dutyWindows {
+		if d > w {
+			w = d
+		}
+	}
+	if p := c.deviceConfig(m).Protection; p != nil && time.Duration(p.DutyWindow) > w {
+		w = time.Duration(p.DutyWindow)
+	}
+	return w
+}
+
+// trimTransitions discards transitions no longer needed to know the state
+// of the device at cutoff.
+func (m *Monitor) trimTransitions(cutoff time.Time) {
+	t := m.State.Transitions
+	i := 0
+	for i+1 < len(t) && !t[i+1].Time.After(cutoff) {
+		i++
+	}
+	if i > 0 {
+		m.State.Transitions = append([]Transition(nil), t[i:]...)
+	}
+}
+
+// Duty returns the fraction of the window ending at now during which the
+// device was ON, along with how much of that window is covered by the
+// transition history.  Time spent unpowered is excluded from both.
+func (s *MonitorState) Duty(now time.Time, window time.Duration) (float64, time.Duration) {
+	start := now.Add(-window)
+	var on, observed time.Duration
+	for i, t := range s.Transitions {
+		end := now
+		if i+1 < len(s.Transitions) {
+			end = s.Transitions[i+1].Time
+		}
+		from := t.Time
+		if from.Before(start) {
+			from = start
+		}
+		if !end.After(from) || t.Unpowered {
+			continue
+		}
+		observed += end.Sub(from)
+		if t.On {
+			on += end.Sub(from)
+		}
+	}
+	if observed == 0 {
+		return 0, 0
+	}
+	return float64(on) / float64(observed), observed
+}
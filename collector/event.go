@@ -0,0 +1,176 @@
+package collector
+
+import (
+	"flag"
+	"sort"
+	"time"
+)
+
+var eventHistory = flag.Int("event-history", 100, "Number of recent events retained per device")
+
+type EventType string
+
+const (
+	EventSample     EventType = "sample"
+	EventOn         EventType = "on"
+	EventOff        EventType = "off"
+	EventRelayOn    EventType = "relay_on"
+	EventRelayOff   EventType = "relay_off"
+	EventPowerCycle EventType = "power_cycle"
+	EventUnpowered  EventType = "unpowered"
+	EventPowered    EventType = "powered"
+)
+
+// Event is something which happened to a device, retained in its
+// MonitorState history and passed to any EventSinks.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Device string    `json:"device"`
+	Alias  string    `json:"alias,omitempty"`
+	Addr   string    `json:"addr,omitempty"`
+	Type   EventType `json:"type"`
+	Detail string    `json:"detail,omitempty"`
+
+	// for transitions, the duration of the phase just ended (in
+	// nanoseconds, and seconds) and the power drawn at the transition
+	Duration        time.Duration `json:"duration,omitempty"`
+	DurationSeconds float64       `json:"duration_seconds,omitempty"`
+	Power           float64       `json:"power,omitempty"`
+	Cycle           *Cycle        `json:"cycle,omitempty"`
+
+	Sample *Sample `json:"sample,omitempty"`
+	Alert  *Alert  `json:"alert,omitempty"`
+}
+
+// Sample is a single poll of a device.
+type Sample struct {
+	Power      float64 `json:"power"`
+	Voltage    float64 `json:"voltage"`
+	Current    float64 `json:"current"`
+	TotalKwH   float64 `json:"total_kwh"`
+	On         bool    `json:"on"`
+	Unpowered  bool    `json:"unpowered,omitempty"`
+	RelayState bool    `json:"relay_state"`
+}
+
+// Cycle is a completed ON or OFF phase of a device's duty cycle.
+type Cycle struct {
+	On              bool          `json:"on"`
+	Start           time.Time     `json:"start"`
+	End             time.Time     `json:"end"`
+	Duration        time.Duration `json:"duration"`
+	DurationSeconds float64       `json:"duration_seconds,omitempty"`
+	EnergyKwH       float64       `json:"energy_kwh,omitempty"` // ON phases of metering plugs
+	Power           *PowerStats   `json:"power,omitempty"`      // ON phases of metering plugs
+}
+
+// EventSink receives every Event, in order and one at a time, after the
+// Collector's lock has been released.
+type EventSink interface {
+	HandleEvent(Event)
+}
+
+// AddSink arranges for s to receive all subsequent events.
+func (c *Collector) AddSink(s EventSink) {
+	c.Lock()
+	defer c.Unlock()
+	c.sinks = append(c.sinks, s)
+}
+
+// flush passes events recorded since the last flush to the sinks.
+// Flushes are serialized, so that one from the poll loop and one from a
+// relay change can't deliver their events concurrently or out of order.
+func (c *Collector) flush() {
+	c.delivery.Lock()
+	defer c.delivery.Unlock()
+	c.Lock()
+	var events []Event
+	var identities []Identity
+	for _, m := range c.Monitors {
+		events = append(events, m.outbox...)
+		if len(c.subscribers) > 0 {
+			id := m.Identity()
+			for range m.outbox {
+				identities = append(identities, id)
+			}
+		}
+		m.outbox = nil
+	}
+	sinks, subscribers := c.sinks, c.subscribers
+	c.Unlock()
+	order := make([]int, len(events))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return events[order[i]].Time.Before(events[order[j]].Time) })
+	for _, i := range order {
+		e := events[i]
+		for _, s := range sinks {
+			s.HandleEvent(e)
+		}
+		if len(subscribers) == 0 {
+			continue
+		}
+		if te := typed(e, identities[i]); te != nil {
+			for _, s := range subscribers {
+				s.deliver(te)
+			}
+		}
+	}
+}
+
+func (m *Monitor) record(now time.Time, t EventType, detail string) {
+	m.add(Event{Time: now, Type: t, Detail: detail})
+}
+
+// recordTransition records a change of duty state; start is when the
+// phase just ended began, if known.
+func (m *Monitor) recordTransition(now time.Time, t EventType, start time.Time) {
+	e := Event{Time: now, Type: t, Power: m.State.Power}
+	if !start.IsZero() {
+		e.Duration = now.Sub(start)
+		e.DurationSeconds = e.Duration.Seconds()
+		e.Cycle = &Cycle{
+			On:              t == EventOff,
+			Start:           start,
+			End:             now,
+			Duration:        e.Duration,
+			DurationSeconds: e.DurationSeconds,
+		}
+		if t == EventOff && m.State.Metering {
+			e.Cycle.EnergyKwH = m.State.LastOnEnergyKwH
+			ps := m.State.LastOnPower
+			e.Cycle.Power = &ps
+		}
+	}
+	m.add(e)
+}
+
+func (m *Monitor) recordSample(now time.Time) {
+	m.emit(Event{Time: now, Type: EventSample, Sample: &Sample{
+		Power:      m.State.Power,
+		Voltage:    m.State.Voltage,
+		Current:    m.State.Current,
+		TotalKwH:   m.State.TotalKwH,
+		On:         m.State.CycleState,
+		Unpowered:  m.State.Unpowered,
+		RelayState: m.State.RelayState,
+	}})
+}
+
+// add appends an event to m's history, discarding the oldest events
+// beyond -event-history, and queues it for the sinks.
+func (m *Monitor) add(e Event) {
+	e.Device, e.Alias, e.Addr = m.ID(), m.State.Alias, m.Addr
+	m.State.Events = append(m.State.Events, e)
+	if n := len(m.State.Events) - *eventHistory; n > 0 {
+		m.State.Events = append([]Event(nil), m.State.Events[n:]...)
+	}
+	m.outbox = append(m.outbox, e)
+}
+
+// emit queues an event for the sinks without retaining it in m's history.
+func (m *Monitor) emit(e Event) {
+	e.Device, e.Alias, e.Addr = m.ID(), m.State.Alias, m.Addr
+	m.outbox = append(m.outbox, e)
+}
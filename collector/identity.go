@@ -0,0 +1,37 @@
+package collector
+
+// Identity is what a device reports about itself.
+type Identity struct {
+	DeviceID        string `json:"device_id"`
+	Addr            string `json:"addr"`
+	MAC             string `json:"mac"`
+	Model           string `json:"model"`
+	Alias           string `json:"alias"`
+	SoftwareVersion string `json:"sw_ver,omitempty"`
+	HardwareVersion string `json:"hw_ver,omitempty"`
+}
+
+// Identity returns the identity of m's device.
+func (m *Monitor) Identity() Identity {
+	return Identity{
+		DeviceID:        m.ID(),
+		Addr:            m.Addr,
+		MAC:             m.State.MAC,
+		Model:           m.State.Model,
+		Alias:           m.State.Alias,
+		SoftwareVersion: m.State.SoftwareVersion,
+		HardwareVersion: m.State.HardwareVersion,
+	}
+}
+
+// Identify returns the identity of the device identified by key (as for
+// Lookup).
+func (c *Collector) Identify(key string) (Identity, bool) {
+	c.Lock()
+	defer c.Unlock()
+	m := c.Lookup(key)
+	if m == nil {
+		return Identity{}, false
+	}
+	return m.Identity(), true
+}
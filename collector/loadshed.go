@@ -0,0 +1,135 @@
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+var powerBudgetWatts = flag.Float64("power-budget-watts", 0, "Total power across all plugs above which low-priority plugs are switched off (0 to disable load shedding)")
+var loadShedHysteresisWatts = flag.Float64("load-shed-hysteresis-watts", 100, "Headroom required below the power budget before a shed plug is restored")
+var loadShedHoldoff = flag.Duration("load-shed-holdoff", time.Minute, "Minimum time between load shedding actions")
+
+const (
+	EventLoadShed    EventType = "load_shed"
+	EventLoadRestore EventType = "load_restore"
+)
+
+// LoadShed makes a device eligible to be switched off when total power
+// exceeds -power-budget-watts.  Lower priorities are shed first and
+// restored last.
+type LoadShed struct {
+	Priority int `json:"priority"`
+	// Watts is the draw expected when the device is restored; if unset, its
+	// draw when shed is used.
+	Watts float64 `json:"watts,omitempty"`
+}
+
+// shedCandidates returns the sheddable Monitors, lowest priority first.
+// The caller must hold the Collector's lock.
+func (c *Collector) shedCandidates() []*Monitor {
+	var ms []*Monitor
+	for _, m := range c.Monitors {
+		if c.deviceConfig(m).LoadShed != nil {
+			ms = append(ms, m)
+		}
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		pi, pj := c.deviceConfig(ms[i]).LoadShed.Priority, c.deviceConfig(ms[j]).LoadShed.Priority
+		if pi != pj {
+			return pi < pj
+		}
+		return ms[i].ID() < ms[j].ID()
+	})
+	return ms
+}
+
+// TotalPower is the sum of the most recent power samples of all devices.
+// The caller must hold the Collector's lock.
+func (c *Collector) TotalPower() float64 {
+	var total float64
+	for _, m := range c.Monitors {
+		if !m.State.Timestamp.IsZero() {
+			total += m.State.Power
+		}
+	}
+	return total
+}
+
+// shedLoad keeps total power under -power-budget-watts, switching off at
+// most one device (lowest priority first) when over budget, or restoring
+// at most one (highest priority first) when there is headroom for it.
+// Devices drawing less than their threshold, such as appliances in their
+// OFF phase, are passed over: switching them off wouldn't help.
+func (c *Collector) shedLoad() {
+	if *powerBudgetWatts <= 0 {
+		return
+	}
+	c.Lock()
+	now := c.time.Now()
+	if now.Sub(c.lastLoadShed) < *loadShedHoldoff {
+		c.Unlock()
+		return
+	}
+	total := c.TotalPower()
+	candidates := c.shedCandidates()
+	var shed, restore *Monitor
+	var reason string
+	if total > *powerBudgetWatts {
+		for _, m := range candidates {
+			if !m.State.Shed && m.State.RelayState && m.State.Power >= m.ThresholdWatts {
+				shed = m
+				reason = fmt.Sprintf("total %.1fw exceeds budget of %.1fw", total, *powerBudgetWatts)
+				break
+			}
+		}
+	} else {
+		for i := len(candidates) - 1; i >= 0; i-- {
+			m := candidates[i]
+			if !m.State.Shed || m.State.Tripped {
+				continue
+			}
+			want := m.State.ShedWatts
+			if w := c.deviceConfig(m).LoadShed.Watts; w > 0 {
+				want = w
+			}
+			if total+want+*loadShedHysteresisWatts <= *powerBudgetWatts {
+				restore = m
+				reason = fmt.Sprintf("total %.1fw leaves room for %.1fw under budget of %.1fw", total, want, *powerBudgetWatts)
+			}
+			// restore strictly in priority order
+			break
+		}
+	}
+	c.Unlock()
+
+	switch {
+	case shed != nil:
+		c.Lock()
+		draw := shed.State.Power
+		c.Unlock()
+		log.Printf("%s: shedding load: %s", shed.ID(), reason)
+		if err := c.setRelay(shed, false, "load shedding"); err != nil {
+			log.Printf("%s: error shedding load: %v", shed.ID(), err)
+			return
+		}
+		c.Lock()
+		shed.State.Shed = true
+		shed.State.ShedWatts = draw
+		shed.record(now, EventLoadShed, reason)
+		c.lastLoadShed = now
+		c.Unlock()
+	case restore != nil:
+		log.Printf("%s: restoring load: %s", restore.ID(), reason)
+		if err := c.setRelay(restore, true, "load shedding"); err != nil {
+			log.Printf("%s: error restoring load: %v", restore.ID(), err)
+			return
+		}
+		c.Lock()
+		restore.record(now, EventLoadRestore, reason)
+		c.lastLoadShed = now
+		c.Unlock()
+	}
+}
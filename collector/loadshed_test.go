@@ -0,0 +1,139 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func TestShedLoad(t *testing.T) {
+	*powerBudgetWatts = 1000
+	defer func() { *powerBudgetWatts = 0 }()
+
+	clock := clockwork.NewFakeClockAt(mustParseTime(time.RFC3339, "2024-03-12T20:00:00Z"))
+	c := New([]string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}, "", clock)
+	c.config["127.0.0.1"] = DeviceConfig{LoadShed: &LoadShed{Priority: 1}}
+	c.config["127.0.0.2"] = DeviceConfig{LoadShed: &LoadShed{Priority: 2}}
+	// 127.0.0.3 is never shed
+	plugs := map[string]*fakePlug{}
+	for _, a := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+		plugs[a] = &fakePlug{}
+		m := c.MonitorAt(a)
+		m.client = plugs[a]
+		m.State.Timestamp = clock.Now()
+		m.State.RelayState = true
+		m.State.Power = 400
+	}
+
+	c.shedLoad()
+	if calls := plugs["127.0.0.1"].calls(); len(calls) != 1 || calls[0] {
+		t.Fatalf("want lowest priority plug shed, got %v", calls)
+	}
+	c.MonitorAt("127.0.0.1").State.Power = 0
+
+	// within the holdoff, nothing happens even though still over budget
+	c.MonitorAt("127.0.0.3").State.Power = 700
+	clock.Advance(10 * time.Second)
+	c.shedLoad()
+	if calls := plugs["127.0.0.2"].calls(); len(calls) != 0 {
+		t.Fatalf("want no action within holdoff, got %v", calls)
+	}
+	clock.Advance(time.Minute)
+	c.shedLoad()
+	if calls := plugs["127.0.0.2"].calls(); len(calls) != 1 || calls[0] {
+		t.Fatalf("want next priority plug shed, got %v", calls)
+	}
+	c.MonitorAt("127.0.0.2").State.Power = 0
+
+	// 700w used; restoring 127.0.0.2's 400w would exceed the budget
+	clock.Advance(time.Minute)
+	c.shedLoad()
+	if calls := plugs["127.0.0.2"].calls(); len(calls) != 1 {
+		t.Fatalf("want no restore without headroom, got %v", calls)
+	}
+	c.MonitorAt("127.0.0.3").State.Power = 400
+	clock.Advance(time.Minute)
+	c.shedLoad()
+	if calls := plugs["127.0.0.2"].calls(); len(calls) != 2 || !calls[1] {
+		t.Fatalf("want highest priority shed plug restored, got %v", calls)
+	}
+	if calls := plugs["127.0.0.1"].calls(); len(calls) != 1 {
+		t.Errorf("want lower priority plug left shed, got %v", calls)
+	}
+	if m := c.MonitorAt("127.0.0.1"); !m.State.Shed || m.State.Events[len(m.State.Events)-1].Type != EventLoadShed {
+		t.Errorf("want shed state and event recorded, got %v", m.State)
+	}
+}
+
+func TestShedLoadPassesOverIdle(t *testing.T) {
+	*powerBudgetWatts = 1000
+	defer func() { *powerBudgetWatts = 0 }()
+
+	clock := clockwork.NewFakeClockAt(mustParseTime(time.RFC3339, "2024-03-12T20:00:00Z"))
+	c := New([]string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}, "", clock)
+	c.config["127.0.0.1"] = DeviceConfig{LoadShed: &LoadShed{Priority: 1}}
+	c.config["127.0.0.2"] = DeviceConfig{LoadShed: &LoadShed{Priority: 2}}
+	plugs := map[string]*fakePlug{}
+	for a, w := range map[string]float64{"127.0.0.1": 0.5, "127.0.0.2": 400, "127.0.0.3": 700} {
+		plugs[a] = &fakePlug{}
+		m := c.MonitorAt(a)
+		m.client = plugs[a]
+		m.State.Timestamp = clock.Now()
+		m.State.RelayState = true
+		m.State.Power = w
+	}
+
+	// the lowest priority plug is between cycles; switching it off wouldn't help
+	c.shedLoad()
+	if calls := plugs["127.0.0.1"].calls(); len(calls) != 0 {
+		t.Errorf("want idle plug passed over, got %v", calls)
+	}
+	if calls := plugs["127.0.0.2"].calls(); len(calls) != 1 || calls[0] {
+		t.Errorf("want next priority plug shed, got %v", calls)
+	}
+}
+
+func TestShedLoadRelayOnOutsideAPI(t *testing.T) {
+	*powerBudgetWatts = 1000
+	defer func() { *powerBudgetWatts = 0 }()
+
+	clock := clockwork.NewFakeClockAt(mustParseTime(time.RFC3339, "2024-03-12T20:00:00Z"))
+	c := New([]string{"127.0.0.1", "127.0.0.2"}, "", clock)
+	c.config["127.0.0.1"] = DeviceConfig{LoadShed: &LoadShed{Priority: 1}}
+	p := &fakePlug{}
+	m := c.MonitorAt("127.0.0.1")
+	m.client = p
+	m.State.Timestamp = clock.Now()
+	m.State.RelayState = true
+	m.State.Power = 400
+	other := c.MonitorAt("127.0.0.2")
+	other.client = &fakePlug{}
+	other.State.Timestamp = clock.Now()
+	other.State.Power = 700
+
+	c.shedLoad()
+	if !m.State.Shed {
+		t.Fatalf("want plug shed")
+	}
+
+	// switched back on from the Kasa app
+	clock.Advance(time.Minute)
+	m.sample(clock.Now(), sysinfoResponse, rtOn)
+	if m.State.Shed {
+		t.Errorf("want shed cleared once the relay is seen on")
+	}
+	restored := false
+	for _, e := range m.State.Events {
+		restored = restored || e.Type == EventLoadRestore
+	}
+	if !restored {
+		t.Errorf("want restore recorded, got %v", m.State.Events)
+	}
+	m.State.Power = 400
+	clock.Advance(time.Minute)
+	c.shedLoad()
+	if calls := p.calls(); len(calls) != 2 || calls[0] || calls[1] {
+		t.Errorf("want plug shed again, got %v", calls)
+	}
+}
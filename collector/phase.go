@@ -0,0 +1,87 @@
+package collector
+
+import (
+	"flag"
+	"time"
+)
+
+var energyCounterResolution = flag.Float64("energy-counter-resolution-kwh", 0.001, "Resolution of plugs' energy counters; cycles using less than ten times this are measured by integrating power instead")
+
+// PowerStats summarizes the power drawn over an ON phase.
+type PowerStats struct {
+	PeakWatts   float64 `json:"peak_watts"`
+	MeanWatts   float64 `json:"mean_watts"`
+	MinWatts    float64 `json:"min_watts"`
+	InrushWatts float64 `json:"inrush_watts"` // first sample
+}
+
+// PhaseStats accumulates measurements over the current ON phase.
+type PhaseStats struct {
+	StartKwH      float64 `json:"start_kwh"`      // energy counter at the start
+	IntegratedKwH float64 `json:"integrated_kwh"` // power integrated over samples
+
+	Samples     int     `json:"samples"`
+	SumWatts    float64 `json:"sum_watts"`
+	PeakWatts   float64 `json:"peak_watts"`
+	MinWatts    float64 `json:"min_watts"`
+	InrushWatts float64 `json:"inrush_watts"`
+}
+
+func (m *Monitor) startPhase() {
+	p := m.State.Power
+	m.State.OnPhase = PhaseStats{
+		StartKwH:    m.State.TotalKwH,
+		Samples:     1,
+		SumWatts:    p,
+		PeakWatts:   p,
+		MinWatts:    p,
+		InrushWatts: p,
+	}
+}
+
+// observe folds the power of a sample taken during the ON phase into its
+// statistics.
+func (m *Monitor) observe() {
+	p, s := m.State.Power, &m.State.OnPhase
+	s.Samples++
+	s.SumWatts += p
+	s.PeakWatts = max(s.PeakWatts, p)
+	s.MinWatts = min(s.MinWatts, p)
+}
+
+func (p *PhaseStats) power() PowerStats {
+	ps := PowerStats{
+		PeakWatts:   p.PeakWatts,
+		MinWatts:    p.MinWatts,
+		InrushWatts: p.InrushWatts,
+	}
+	if p.Samples > 0 {
+		ps.MeanWatts = p.SumWatts / float64(p.Samples)
+	}
+	return ps
+}
+
+// accumulate folds a sample into the ON phase statistics, given the time
+// and power of the previous sample.  Power isn't integrated across gaps of
+// more than two sample intervals (after an offline spell or a restart), as
+// what it was meanwhile isn't known.
+func (m *Monitor) accumulate(now, prev time.Time, prevPower float64) {
+	if prev.IsZero() || !now.After(prev) {
+		return
+	}
+	if iv := m.interval; iv > 0 && now.Sub(prev) > 2*iv {
+		return
+	}
+	// trapezoidal; watt-hours to kWh
+	m.State.OnPhase.IntegratedKwH += (prevPower + m.State.Power) / 2 * now.Sub(prev).Hours() / 1000
+}
+
+// energy returns the energy used over the ON phase: the change in the
+// plug's energy counter, unless that's too coarse to be meaningful (or the
+// counter has been reset), in which case the integrated power.
+func (p *PhaseStats) energy(totalKwH float64) float64 {
+	if delta := totalKwH - p.StartKwH; delta >= 10**energyCounterResolution {
+		return delta
+	}
+	return p.IntegratedKwH
+}
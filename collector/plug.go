@@ -0,0 +1,46 @@
+package collector
+
+import (
+	"github.com/fffonion/tplink-plug-exporter/kasa"
+)
+
+// plug is the subset of the Smart Home protocol the collector speaks to a
+// device.
+type plug interface {
+	SysInfo() (*kasa.GetSysInfoResponse, error)
+	Realtime() (*kasa.GetRealtimeResponse, error)
+	SetRelayState(on bool) error
+}
+
+type kasaPlug struct {
+	client *kasa.KasaClient
+}
+
+func newKasaPlug(addr string) plug {
+	return &kasaPlug{
+		client: kasa.New(&kasa.KasaClientConfig{
+			Host: addr,
+		}),
+	}
+}
+
+func (p *kasaPlug) SysInfo() (*kasa.GetSysInfoResponse, error) {
+	return p.client.SystemService(nil).GetSysInfo()
+}
+
+func (p *kasaPlug) Realtime() (*kasa.GetRealtimeResponse, error) {
+	return p.client.EmeterService(nil).GetRealtime()
+}
+
+type setRelayStateRequest struct {
+	State int `json:"state"`
+}
+
+func (p *kasaPlug) SetRelayState(on bool) error {
+	req := setRelayStateRequest{}
+	if on {
+		req.State = 1
+	}
+	var resp kasa.RPCResponse
+	return p.client.RPC("system", "set_relay_state", nil, req, &resp)
+}
@@ -0,0 +1,75 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	EventProtectionTrip  EventType = "protection_trip"
+	EventProtectionReset EventType = "protection_reset"
+)
+
+// protectionCheck decides whether m's protection limits require its relay
+// to be switched off (trip) or permit it to be switched back on (reset).
+// The caller must hold the Collector's lock.
+func (c *Collector) protectionCheck(m *Monitor, now time.Time) (trip, reset bool, reason string) {
+	p := c.deviceConfig(m).Protection
+	if p == nil {
+		return false, false, ""
+	}
+	if m.State.Tripped {
+		if p.Cooldown > 0 && now.Sub(m.State.TrippedAt) >= time.Duration(p.Cooldown) {
+			return false, true, fmt.Sprintf("cooldown of %s elapsed", time.Duration(p.Cooldown))
+		}
+		return false, false, ""
+	}
+	if p.MaxOnTime > 0 && m.State.CycleState && !m.State.LastOn.IsZero() {
+		if on := now.Sub(m.State.LastOn); on > time.Duration(p.MaxOnTime) {
+			return true, false, fmt.Sprintf("on for %s, limit %s", on, time.Duration(p.MaxOnTime))
+		}
+	}
+	if p.MaxDuty > 0 {
+		window := time.Duration(p.DutyWindow)
+		frac, observed := m.State.Duty(now, window)
+		// unobserved time counts as off, so a young history can't trip early
+		if on := time.Duration(frac * float64(observed)); on > time.Duration(p.MaxDuty*float64(window)) {
+			return true, false, fmt.Sprintf("on for %s of the last %s, limit %.0f%%", on, window, p.MaxDuty*100)
+		}
+	}
+	return false, false, ""
+}
+
+// protect enforces m's protection limits, switching its relay as needed.
+func (c *Collector) protect(m *Monitor) {
+	c.Lock()
+	now := c.time.Now()
+	trip, reset, reason := c.protectionCheck(m, now)
+	id := m.ID()
+	c.Unlock()
+
+	switch {
+	case trip:
+		log.Printf("%s: protection tripped: %s", id, reason)
+		if err := c.setRelay(m, false, "protection"); err != nil {
+			log.Printf("%s: error switching off tripped device: %v", id, err)
+			return
+		}
+		c.Lock()
+		m.State.Tripped = true
+		m.State.TrippedAt = now
+		m.State.ProtectionTrips++
+		m.record(now, EventProtectionTrip, reason)
+		c.Unlock()
+	case reset:
+		log.Printf("%s: protection reset: %s", id, reason)
+		if err := c.setRelay(m, true, "protection"); err != nil {
+			log.Printf("%s: error switching on device after cooldown: %v", id, err)
+			return
+		}
+		c.Lock()
+		m.record(now, EventProtectionReset, reason)
+		c.Unlock()
+	}
+}
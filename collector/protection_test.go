@@ -0,0 +1,151 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func TestDuty(t *testing.T) {
+	start := mustParseTime(time.RFC3339, "2024-03-12T20:00:00Z")
+	s := MonitorState{Transitions: []Transition{
+		{Time: start, On: true},
+		{Time: start.Add(15 * time.Minute), On: false},
+		{Time: start.Add(45 * time.Minute), On: true},
+	}}
+	now := start.Add(time.Hour)
+	if frac, observed := s.Duty(now, time.Hour); frac != 0.5 || observed != time.Hour {
+		t.Errorf("want 50%% of 1h, got %f of %s", frac, observed)
+	}
+	if frac, observed := s.Duty(now, 30*time.Minute); frac != 0.5 || observed != 30*time.Minute {
+		t.Errorf("want 50%% of 30m, got %f of %s", frac, observed)
+	}
+	if frac, observed := s.Duty(now, 2*time.Hour); frac != 0.5 || observed != time.Hour {
+		t.Errorf("want 50%% of 1h observed, got %f of %s", frac, observed)
+	}
+
+	m := &Monitor{State: s}
+	m.trimTransitions(start.Add(20 * time.Minute))
+	if len(m.State.Transitions) != 2 || m.State.Transitions[0].On {
+		t.Errorf("want off transition kept as state at cutoff, got %v", m.State.Transitions)
+	}
+}
+
+func TestProtectionMaxOnTime(t *testing.T) {
+	clock := clockwork.NewFakeClockAt(mustParseTime(time.RFC3339, "2024-03-12T20:00:00Z"))
+	c := New([]string{"127.0.0.1"}, "", clock)
+	c.config["127.0.0.1"] = DeviceConfig{Protection: &Protection{
+		MaxOnTime: Duration(30 * time.Minute),
+		Cooldown:  Duration(10 * time.Minute),
+	}}
+	m := c.MonitorAt("127.0.0.1")
+	p := &fakePlug{}
+	m.client = p
+
+	for i := 0; i < 5; i++ {
+		m.sample(clock.Now(), sysinfoResponse, rtOn)
+		c.protect(m)
+		clock.Advance(10 * time.Minute)
+	}
+	if calls := p.calls(); len(calls) != 1 || calls[0] {
+		t.Fatalf("want relay switched off after 30m on, got %v", calls)
+	}
+	if !m.State.Tripped || m.State.ProtectionTrips != 1 {
+		t.Errorf("want tripped, got %v (%d trips)", m.State.Tripped, m.State.ProtectionTrips)
+	}
+
+	sysOff := *sysinfoResponse
+	sysOff.RelayState = 0
+	m.sample(clock.Now(), &sysOff, rtOff)
+	c.protect(m)
+	if calls := p.calls(); len(calls) != 2 || !calls[1] {
+		t.Errorf("want relay switched back on after cooldown, got %v", calls)
+	}
+	if m.State.Tripped {
+		t.Errorf("want protection reset after cooldown")
+	}
+}
+
+func TestProtectionRelayOnOutsideAPI(t *testing.T) {
+	clock := clockwork.NewFakeClockAt(mustParseTime(time.RFC3339, "2024-03-12T20:00:00Z"))
+	c := New([]string{"127.0.0.1"}, "", clock)
+	c.config["127.0.0.1"] = DeviceConfig{Protection: &Protection{
+		MaxOnTime: Duration(30 * time.Minute),
+	}}
+	m := c.MonitorAt("127.0.0.1")
+	p := &fakePlug{}
+	m.client = p
+
+	for i := 0; i < 5; i++ {
+		m.sample(clock.Now(), sysinfoResponse, rtOn)
+		c.protect(m)
+		clock.Advance(10 * time.Minute)
+	}
+	if !m.State.Tripped {
+		t.Fatalf("want tripped after 30m on")
+	}
+	sysOff := *sysinfoResponse
+	sysOff.RelayState = 0
+	m.sample(clock.Now(), &sysOff, rtOff)
+	c.protect(m)
+	if !m.State.Tripped {
+		t.Fatalf("want trip kept while the relay is off, without cooldown")
+	}
+
+	// switched back on from the Kasa app
+	clock.Advance(time.Minute)
+	for i := 0; i < 5; i++ {
+		m.sample(clock.Now(), sysinfoResponse, rtOn)
+		if i == 0 && m.State.Tripped {
+			t.Errorf("want trip cleared once the relay is seen on")
+		}
+		c.protect(m)
+		clock.Advance(10 * time.Minute)
+	}
+	if calls := p.calls(); len(calls) != 2 || calls[0] || calls[1] {
+		t.Errorf("want relay switched off twice, got %v", calls)
+	}
+	if !m.State.Tripped || m.State.ProtectionTrips != 2 {
+		t.Errorf("want tripped again, got %v (%d trips)", m.State.Tripped, m.State.ProtectionTrips)
+	}
+}
+
+func TestProtectionMaxDuty(t *testing.T) {
+	clock := clockwork.NewFakeClockAt(mustParseTime(time.RFC3339, "2024-03-12T20:00:00Z"))
+	c := New([]string{"127.0.0.1"}, "", clock)
+	c.config["127.0.0.1"] = DeviceConfig{Protection: &Protection{
+		MaxDuty:    0.5,
+		DutyWindow: Duration(time.Hour),
+	}}
+	m := c.MonitorAt("127.0.0.1")
+	p := &fakePlug{}
+	m.client = p
+
+	// 20m on, 10m off, 20m on: 40m of the last 50m, but under 30m of the hour
+	// until the second run passes 30m in total
+	steps := []struct {
+		on      bool
+		minutes int
+	}{{true, 20}, {false, 10}, {true, 10}}
+	for _, st := range steps {
+		rt := rtOff
+		if st.on {
+			rt = rtOn
+		}
+		for i := 0; i < st.minutes; i++ {
+			m.sample(clock.Now(), sysinfoResponse, rt)
+			c.protect(m)
+			clock.Advance(time.Minute)
+		}
+	}
+	if calls := p.calls(); len(calls) != 0 {
+		t.Fatalf("want no trip at 29m of on time, got %v", calls)
+	}
+	clock.Advance(2 * time.Minute)
+	m.sample(clock.Now(), sysinfoResponse, rtOn)
+	c.protect(m)
+	if calls := p.calls(); len(calls) != 1 || calls[0] {
+		t.Errorf("want trip beyond 30m of on time, got %v", calls)
+	}
+}
@@ -0,0 +1,87 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var ErrNoSuchDevice = errors.New("no such device")
+
+// Lookup finds a Monitor by device ID, address or (case-insensitively)
+// alias.  The caller must hold the Collector's lock.
+func (c *Collector) Lookup(key string) *Monitor {
+	if m, ok := c.Monitors[key]; ok {
+		return m
+	}
+	if m := c.MonitorAt(key); m != nil {
+		return m
+	}
+	for _, m := range c.Monitors {
+		if m.State.Alias != "" && strings.EqualFold(m.State.Alias, key) {
+			return m
+		}
+	}
+	return nil
+}
+
+// SetRelay switches the relay of the device identified by key (as for
+// Lookup) on or off, recording the action in the device's history.
+// source describes who asked, for the record.
+func (c *Collector) SetRelay(key string, on bool, source string) error {
+	c.Lock()
+	m := c.Lookup(key)
+	c.Unlock()
+	if m == nil {
+		return ErrNoSuchDevice
+	}
+	return c.setRelay(m, on, source)
+}
+
+func (c *Collector) setRelay(m *Monitor, on bool, source string) error {
+	c.Lock()
+	client, id := m.client, m.ID()
+	c.Unlock()
+
+	if err := client.SetRelayState(on); err != nil {
+		return fmt.Errorf("setting relay of %s: %w", id, err)
+	}
+
+	c.Lock()
+	t := EventRelayOff
+	if on {
+		t = EventRelayOn
+	}
+	m.State.RelayState = on
+	if on {
+		m.State.Tripped = false
+		m.State.Shed = false
+	}
+	m.record(c.time.Now(), t, source)
+	log.Printf("%s: relay switched %v by %s", m.ID(), on, source)
+	c.Unlock()
+	c.flush()
+	return nil
+}
+
+// PowerCycle switches the relay of the device identified by key off, then
+// back on after delay.  It returns once the relay is off.
+func (c *Collector) PowerCycle(key string, delay time.Duration, source string) error {
+	if err := c.SetRelay(key, false, source); err != nil {
+		return err
+	}
+	c.Lock()
+	if m := c.Lookup(key); m != nil {
+		m.record(c.time.Now(), EventPowerCycle, fmt.Sprintf("%s, %s", source, delay))
+	}
+	c.Unlock()
+	c.flush()
+	c.time.AfterFunc(delay, func() {
+		if err := c.SetRelay(key, true, source); err != nil {
+			log.Printf("error restoring power to %s after power cycle: %v", key, err)
+		}
+	})
+	return nil
+}
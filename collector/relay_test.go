@@ -0,0 +1,167 @@
+package collector
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fffonion/tplink-plug-exporter/kasa"
+	"github.com/jonboulle/clockwork"
+)
+
+type fakePlug struct {
+	sync.Mutex
+	sys    *kasa.GetSysInfoResponse
+	rt     *kasa.GetRealtimeResponse
+	err    error // of polls and relay changes
+	relays []bool
+}
+
+func (p *fakePlug) SysInfo() (*kasa.GetSysInfoResponse, error)   { return p.sys, p.err }
+func (p *fakePlug) Realtime() (*kasa.GetRealtimeResponse, error) { return p.rt, p.err }
+func (p *fakePlug) SetRelayState(on bool) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.relays = append(p.relays, on)
+	return nil
+}
+
+func (p *fakePlug) calls() []bool {
+	p.Lock()
+	defer p.Unlock()
+	return append([]bool(nil), p.relays...)
+}
+
+func TestSetRelay(t *testing.T) {
+	c := New([]string{"127.0.0.1"}, "", clockwork.NewFakeClock())
+	p := &fakePlug{}
+	c.MonitorAt("127.0.0.1").client = p
+	if err := c.SetRelay("127.0.0.2", false, "test"); err != ErrNoSuchDevice {
+		t.Errorf("want ErrNoSuchDevice, got %v", err)
+	}
+	if err := c.SetRelay("127.0.0.1", true, "test"); err != nil {
+		t.Fatalf("error setting relay: %v", err)
+	}
+	m := c.MonitorAt("127.0.0.1")
+	if !m.State.RelayState || len(p.relays) != 1 || !p.relays[0] {
+		t.Errorf("want relay on, got state %v, calls %v", m.State.RelayState, p.relays)
+	}
+	if len(m.State.Events) != 1 || m.State.Events[0].Type != EventRelayOn {
+		t.Errorf("want relay_on event recorded, got %v", m.State.Events)
+	}
+}
+
+func TestPowerCycle(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	c := New([]string{"127.0.0.1"}, "", clock)
+	p := &fakePlug{}
+	c.MonitorAt("127.0.0.1").client = p
+	if err := c.PowerCycle("127.0.0.1", 30*time.Second, "test"); err != nil {
+		t.Fatalf("error power cycling: %v", err)
+	}
+	if len(p.relays) != 1 || p.relays[0] {
+		t.Errorf("want relay switched off, got %v", p.relays)
+	}
+	m := c.MonitorAt("127.0.0.1")
+	if n := len(m.State.Events); n != 2 || m.State.Events[0].Type != EventRelayOff || m.State.Events[1].Type != EventPowerCycle {
+		t.Errorf("want relay_off and power_cycle events recorded, got %v", m.State.Events)
+	}
+	clock.Advance(30 * time.Second)
+	for i := 0; i < 100 && len(p.calls()) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if calls := p.calls(); len(calls) != 2 || !calls[1] {
+		t.Errorf("want relay switched back on, got %v", calls)
+	}
+}
+
+func TestPowerCycleFailed(t *testing.T) {
+	c := New([]string{"127.0.0.1"}, "", clockwork.NewFakeClock())
+	c.MonitorAt("127.0.0.1").client = &fakePlug{err: errors.New("unreachable")}
+	if err := c.PowerCycle("127.0.0.1", 30*time.Second, "test"); err == nil {
+		t.Fatalf("want error power cycling unreachable plug")
+	}
+	if events := c.MonitorAt("127.0.0.1").State.Events; len(events) != 0 {
+		t.Errorf("want no events recorded, got %v", events)
+	}
+}
+
+func TestEventHistoryBounded(t *testing.T) {
+	m := &Monitor{Addr: "127.0.0.1"}
+	for i := 0; i < *eventHistory+5; i++ {
+		m.record(time.Unix(int64(i), 0), EventRelayOn, "")
+	}
+	if len(m.State.Events) != *eventHistory {
+		t.Errorf("want %d events, got %d", *eventHistory, len(m.State.Events))
+	}
+	if m.State.Events[0].Time != time.Unix(5, 0) {
+		t.Errorf("want oldest events discarded, first is %s", m.State.Events[0].Time)
+	}
+}
+
+// orderSink records the events it's given, noting any given concurrently.
+type orderSink struct {
+	inFlight   atomic.Int32
+	concurrent atomic.Bool
+	events     []Event
+}
+
+func (s *orderSink) HandleEvent(e Event) {
+	if s.inFlight.Add(1) > 1 {
+		s.concurrent.Store(true)
+	}
+	defer s.inFlight.Add(-1)
+	if e.Type != EventSample {
+		s.events = append(s.events, e)
+	}
+	time.Sleep(10 * time.Microsecond)
+}
+
+func TestSetRelayDuringPoll(t *testing.T) {
+	c := New([]string{"127.0.0.1"}, "", clockwork.NewFakeClock())
+	sink := &orderSink{}
+	c.AddSink(sink)
+	sys := *sysinfoResponse
+	sys.Feature = "TIM:ENE"
+	m := c.MonitorAt("127.0.0.1")
+	m.client = &fakePlug{sys: &sys, rt: rtOn}
+	m = c.Lookup("127.0.0.1")
+
+	const n = 40
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			c.poll(m)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if err := c.SetRelay("127.0.0.1", i%2 == 0, "test"); err != nil {
+				t.Errorf("error setting relay: %v", err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	if sink.concurrent.Load() {
+		t.Errorf("want events delivered one at a time")
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(sink.events) != len(m.State.Events) {
+		t.Fatalf("want %d events delivered, got %d", len(m.State.Events), len(sink.events))
+	}
+	for i, e := range sink.events {
+		if want := m.State.Events[i]; e.Type != want.Type || e.Detail != want.Detail {
+			t.Fatalf("event %d: want %s %s, got %s %s", i, want.Type, want.Detail, e.Type, e.Detail)
+		}
+	}
+}
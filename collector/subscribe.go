@@ -0,0 +1,173 @@
+package collector
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EventOnline  EventType = "online"
+	EventOffline EventType = "offline"
+)
+
+// TypedEvent is one of Sampled, TransitionOn, TransitionOff, DeviceOnline,
+// DeviceOffline or AlertChanged, as delivered to subscribers.
+type TypedEvent interface {
+	// EventTime is when the event happened.
+	EventTime() time.Time
+	// EventDevice is the device it happened to.
+	EventDevice() Identity
+}
+
+// Header is common to all TypedEvents.
+type Header struct {
+	Time   time.Time
+	Device Identity
+}
+
+func (h Header) EventTime() time.Time  { return h.Time }
+func (h Header) EventDevice() Identity { return h.Device }
+
+// Sampled is a successful poll of a device.
+type Sampled struct {
+	Header
+	Sample
+}
+
+// TransitionOn is a device's duty state changing to ON.  OffDuration is
+// how long it was OFF, if known.
+type TransitionOn struct {
+	Header
+	Power       float64
+	OffDuration time.Duration
+	Cycle       *Cycle // the OFF phase just ended, if its start is known
+}
+
+// TransitionOff is a device's duty state changing to OFF.  OnDuration is
+// how long it was ON, if known.
+type TransitionOff struct {
+	Header
+	Power      float64
+	OnDuration time.Duration
+	Cycle      *Cycle // the ON phase just ended, if its start is known
+}
+
+// DeviceOnline is a device answering a poll, having not (or never) done so
+// before.
+type DeviceOnline struct {
+	Header
+}
+
+// DeviceOffline is a device failing -offline-after consecutive polls.
+type DeviceOffline struct {
+	Header
+	Err string
+}
+
+// AlertChanged is one of a device's alerts firing or resolving.
+type AlertChanged struct {
+	Header
+	Alert Alert
+}
+
+// typed converts e, an event of the device with identity id, to a
+// TypedEvent, if it's one subscribers are given.
+func typed(e Event, id Identity) TypedEvent {
+	h := Header{Time: e.Time, Device: id}
+	switch e.Type {
+	case EventSample:
+		if e.Sample != nil {
+			return Sampled{h, *e.Sample}
+		}
+	case EventOn:
+		return TransitionOn{h, e.Power, e.Duration, e.Cycle}
+	case EventOff:
+		return TransitionOff{h, e.Power, e.Duration, e.Cycle}
+	case EventOnline:
+		return DeviceOnline{h}
+	case EventOffline:
+		return DeviceOffline{h, e.Detail}
+	case EventAlertFiring, EventAlertResolved:
+		if e.Alert != nil {
+			return AlertChanged{h, *e.Alert}
+		}
+	}
+	return nil
+}
+
+// Subscription delivers TypedEvents on C until its context is done, when C
+// is closed.
+type Subscription struct {
+	C <-chan TypedEvent
+
+	match   func(TypedEvent) bool
+	mu      sync.Mutex
+	c       chan TypedEvent
+	closed  bool
+	dropped atomic.Uint64
+}
+
+// Dropped is the number of events not delivered because C was full.
+// Events the subscription didn't match aren't counted.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// deliver passes e to the subscriber, unless it doesn't match or the
+// buffer is full.
+func (s *Subscription) deliver(e TypedEvent) {
+	if s.match != nil && !s.match(e) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.c <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *Subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	close(s.c)
+}
+
+// Subscribe delivers subsequent events to the returned Subscription, in
+// the order sinks receive them, buffering up to size of them.  Delivery
+// never waits: should the buffer be full, events are dropped.  The
+// subscription ends when ctx is done.
+func (c *Collector) Subscribe(ctx context.Context, size int) *Subscription {
+	return c.SubscribeFunc(ctx, size, nil)
+}
+
+// SubscribeFunc is like Subscribe, but delivers only the events for which
+// match returns true, so that others neither take up the buffer nor count
+// as dropped.  match is called as events are flushed, so should be quick.
+func (c *Collector) SubscribeFunc(ctx context.Context, size int, match func(TypedEvent) bool) *Subscription {
+	ch := make(chan TypedEvent, size)
+	s := &Subscription{C: ch, c: ch, match: match}
+	c.Lock()
+	c.subscribers = append(c.subscribers, s)
+	c.Unlock()
+	go func() {
+		<-ctx.Done()
+		c.Lock()
+		for i, sub := range c.subscribers {
+			if sub == s {
+				c.subscribers = append(c.subscribers[:i:i], c.subscribers[i+1:]...)
+				break
+			}
+		}
+		c.Unlock()
+		s.close()
+	}()
+	return s
+}
@@ -0,0 +1,154 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fffonion/tplink-plug-exporter/kasa"
+	"github.com/jonboulle/clockwork"
+)
+
+func TestSubscribe(t *testing.T) {
+	defer func(n int) { *rediscoverAfter = n }(*rediscoverAfter)
+	*rediscoverAfter = 0
+	clock := clockwork.NewFakeClock()
+	c := New([]string{"127.0.0.1"}, "", clock)
+	sys := *sysinfoResponse
+	sys.Feature = "TIM:ENE"
+	p := &fakePlug{sys: &sys, rt: rtOff}
+	m := c.MonitorAt("127.0.0.1")
+	m.client = p
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := c.Subscribe(ctx, 100)
+	small := c.Subscribe(ctx, 1)
+	offs := c.SubscribeFunc(ctx, 1, func(e TypedEvent) bool {
+		_, ok := e.(TransitionOff)
+		return ok
+	})
+
+	poll := func(rt *kasa.GetRealtimeResponse, err error) {
+		p.rt, p.err = rt, err
+		m := c.Lookup("127.0.0.1")
+		c.poll(m)
+		clock.Advance(time.Minute)
+	}
+	poll(rtOff, nil)
+	poll(rtOn, nil)
+	poll(rtOff, nil)
+	for i := 0; i < *offlineAfter; i++ {
+		poll(nil, errors.New("unreachable"))
+	}
+	cancel()
+
+	var got []string
+	for e := range sub.C {
+		s := fmt.Sprintf("%T", e)
+		switch e := e.(type) {
+		case TransitionOff:
+			s += fmt.Sprintf(" %s", e.OnDuration)
+		case DeviceOffline:
+			s += " " + e.Err
+		}
+		if e.EventDevice().MAC != sys.MAC {
+			t.Errorf("want identity of device, got %+v", e.EventDevice())
+		}
+		got = append(got, s)
+	}
+	want := []string{
+		"collector.DeviceOnline",
+		"collector.Sampled",
+		"collector.TransitionOn",
+		"collector.Sampled",
+		"collector.TransitionOff 1m0s",
+		"collector.Sampled",
+		"collector.DeviceOffline unreachable",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("want events\n%v\ngot\n%v", want, got)
+	}
+	if n := small.Dropped(); n != uint64(len(want)-1) {
+		t.Errorf("want %d events dropped by full subscriber, got %d", len(want)-1, n)
+	}
+	if _, ok := <-small.C; !ok {
+		t.Errorf("want buffered event delivered before close")
+	}
+	if _, ok := <-small.C; ok {
+		t.Errorf("want subscription closed")
+	}
+	if n := offs.Dropped(); n != 0 {
+		t.Errorf("want unmatched events not counted as dropped, got %d", n)
+	}
+	if e, ok := <-offs.C; !ok {
+		t.Errorf("want matching event delivered")
+	} else if _, off := e.(TransitionOff); !off {
+		t.Errorf("want TransitionOff, got %T", e)
+	}
+}
+
+// stallSink holds up delivery of the first sample until released.
+type stallSink struct {
+	once             sync.Once
+	stalled, release chan bool
+}
+
+func (s *stallSink) HandleEvent(e Event) {
+	if e.Type == EventSample {
+		s.once.Do(func() {
+			close(s.stalled)
+			<-s.release
+		})
+	}
+}
+
+func TestSubscribeOrderedAcrossFlushes(t *testing.T) {
+	c := New([]string{"127.0.0.1"}, "", clockwork.NewFakeClock())
+	sys := *sysinfoResponse
+	sys.Feature = "TIM:ENE"
+	p := &fakePlug{sys: &sys, rt: rtOff}
+	m := c.MonitorAt("127.0.0.1")
+	m.client = p
+	sink := &stallSink{stalled: make(chan bool), release: make(chan bool)}
+	c.AddSink(sink)
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := c.Subscribe(ctx, 100)
+
+	first, second := make(chan bool), make(chan bool)
+	go func() {
+		c.poll(m)
+		close(first)
+	}()
+	<-sink.stalled
+	// a second flush, as from a relay change, while the first is delivering
+	p.rt = rtOn
+	go func() {
+		c.poll(c.Lookup("127.0.0.1"))
+		close(second)
+	}()
+	select {
+	case <-second:
+		t.Errorf("want second flush to wait for the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(sink.release)
+	<-first
+	<-second
+	cancel()
+
+	var got []string
+	for e := range sub.C {
+		got = append(got, fmt.Sprintf("%T", e))
+	}
+	want := []string{
+		"collector.DeviceOnline",
+		"collector.Sampled",
+		"collector.TransitionOn",
+		"collector.Sampled",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("want events\n%v\ngot\n%v", want, got)
+	}
+}
@@ -0,0 +1,118 @@
+package discovery
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fffonion/tplink-plug-exporter/kasa"
+	"github.com/mitchellh/mapstructure"
+)
+
+var broadcastAddress = flag.String("discovery-broadcast-address", "255.255.255.255:9999", "Address (and port) to which discovery queries are broadcast")
+var timeout = flag.Duration("discovery-timeout", 2*time.Second, "How long to wait for devices to answer a discovery query")
+
+// Device is a Kasa device which answered a discovery query.
+type Device struct {
+	Addr    string
+	SysInfo *kasa.GetSysInfoResponse
+}
+
+// EmeterSupported reports whether the device advertises energy metering.
+func (d Device) EmeterSupported() bool {
+	return strings.Contains(d.SysInfo.Feature, "ENE")
+}
+
+const key = 171
+
+// The UDP flavor of the Smart Home protocol is the same autokey XOR cipher
+// as the TCP flavor, minus the length prefix.
+func encrypt(in []byte) []byte {
+	out := make([]byte, len(in))
+	k := byte(key)
+	for i, b := range in {
+		k ^= b
+		out[i] = k
+	}
+	return out
+}
+
+func decrypt(in []byte) []byte {
+	out := make([]byte, len(in))
+	k := byte(key)
+	for i, b := range in {
+		out[i] = k ^ b
+		k = b
+	}
+	return out
+}
+
+var query = encrypt([]byte(`{"system":{"get_sysinfo":{}}}`))
+
+func parseResponse(buf []byte) (*kasa.GetSysInfoResponse, error) {
+	var resp map[string]map[string]map[string]interface{}
+	if err := json.Unmarshal(decrypt(buf), &resp); err != nil {
+		return nil, err
+	}
+	if resp["system"] == nil || resp["system"]["get_sysinfo"] == nil {
+		return nil, fmt.Errorf("malformed response: %v", resp)
+	}
+	var sys kasa.GetSysInfoResponse
+	if err := mapstructure.Decode(resp["system"]["get_sysinfo"], &sys); err != nil {
+		return nil, err
+	}
+	return &sys, nil
+}
+
+// Discover broadcasts a sysinfo query using the flag-configured address and
+// timeout.
+func Discover() ([]Device, error) {
+	return DiscoverAt(*broadcastAddress, *timeout)
+}
+
+// DiscoverAt sends a sysinfo query to addr and collects answers until
+// timeout elapses.  Devices are returned sorted by address.
+func DiscoverAt(addr string, timeout time.Duration) ([]Device, error) {
+	dst, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.WriteToUDP(query, dst); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	seen := map[string]Device{}
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		sys, err := parseResponse(buf[:n])
+		if err != nil {
+			log.Printf("ignoring discovery response from %s: %v", from, err)
+			continue
+		}
+		seen[from.IP.String()] = Device{Addr: from.IP.String(), SysInfo: sys}
+	}
+	devices := make([]Device, 0, len(seen))
+	for _, d := range seen {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Addr < devices[j].Addr })
+	return devices, nil
+}
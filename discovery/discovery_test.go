@@ -0,0 +1,53 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCipherRoundTrip(t *testing.T) {
+	in := `{"system":{"get_sysinfo":{}}}`
+	if out := string(decrypt(encrypt([]byte(in)))); out != in {
+		t.Errorf("want %q, got %q", in, out)
+	}
+}
+
+func TestDiscoverAt(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if string(decrypt(buf[:n])) != `{"system":{"get_sysinfo":{}}}` {
+			return
+		}
+		conn.WriteToUDP(encrypt([]byte(`{"system":{"get_sysinfo":{`+
+			`"mac":"aa:bb:cc:dd:ee:ff","model":"KP125(US)","alias":"freezer",`+
+			`"feature":"TIM:ENE","relay_state":1,"deviceId":"FFFF","err_code":0}}}`)), from)
+	}()
+
+	devices, err := DiscoverAt(conn.LocalAddr().String(), 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("error discovering: %v", err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("want 1 device, got %d", len(devices))
+	}
+	d := devices[0]
+	if d.Addr != "127.0.0.1" {
+		t.Errorf("want addr 127.0.0.1, got %s", d.Addr)
+	}
+	if d.SysInfo.Alias != "freezer" || d.SysInfo.MAC != "aa:bb:cc:dd:ee:ff" || d.SysInfo.DeviceID != "FFFF" {
+		t.Errorf("unexpected sysinfo %+v", d.SysInfo)
+	}
+	if !d.EmeterSupported() {
+		t.Errorf("want emeter supported for feature %q", d.SysInfo.Feature)
+	}
+}
@@ -0,0 +1,351 @@
+// Package email mails alert firings and resolutions, and optionally a
+// daily digest of each device's cycles, over SMTP.
+package email
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+var (
+	from         = flag.String("smtp-from", "kasadutycycle@localhost", "Sender of alert emails")
+	to           = flag.String("smtp-to", "", "Comma-separated recipients of alert emails")
+	username     = flag.String("smtp-username", "", "SMTP username")
+	passwordFile = flag.String("smtp-password-file", "", "File holding the SMTP password")
+	startTLS     = flag.Bool("smtp-starttls", true, "Require STARTTLS (if false, it's still used where offered)")
+	tlsInsecure  = flag.Bool("smtp-tls-insecure", false, "Don't verify the SMTP server's certificate")
+	alerts       = flag.Bool("email-alerts", true, "Email alert firings and resolutions")
+	digest       = flag.Bool("email-digest", false, "Email a daily digest of each device's cycles")
+	digestAt     = flag.String("email-digest-time", "07:00", "Local time of day (HH:MM) at which to send the digest")
+)
+
+const queueSize = 100
+
+// Notifier is a collector.EventSink emailing alerts and digests.
+type Notifier struct {
+	collector *collector.Collector
+	server    string // host:port
+	to        []string
+	password  string
+	queue     chan message
+	done      chan struct{}
+	time      clockwork.Clock
+
+	mu      sync.Mutex
+	closed  bool // queue
+	since   time.Time
+	devices map[string]*deviceDigest
+}
+
+type message struct {
+	subject, body string
+}
+
+// deviceDigest accumulates a device's activity since the last digest.
+type deviceDigest struct {
+	alias      string
+	cycles     int
+	onTime     time.Duration
+	longestOn  time.Duration
+	energyKwH  float64
+	alertsSeen map[string]bool
+}
+
+// New returns a Notifier sending through server (host:port).  The digest
+// lists every device monitored by c, if not nil, whether or not it cycled.
+func New(c *collector.Collector, server string, clock clockwork.Clock) (*Notifier, error) {
+	n := &Notifier{
+		collector: c,
+		server:    server,
+		queue:     make(chan message, queueSize),
+		done:      make(chan struct{}),
+		time:      clock,
+		since:     clock.Now(),
+		devices:   map[string]*deviceDigest{},
+	}
+	for _, addr := range strings.Split(*to, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			n.to = append(n.to, addr)
+		}
+	}
+	if len(n.to) == 0 {
+		return nil, fmt.Errorf("no recipients; set -smtp-to")
+	}
+	if *passwordFile != "" {
+		b, err := os.ReadFile(*passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading SMTP password: %w", err)
+		}
+		n.password = strings.TrimSpace(string(b))
+	}
+	go n.run()
+	return n, nil
+}
+
+func (n *Notifier) run() {
+	defer close(n.done)
+	for m := range n.queue {
+		if err := n.send(m.subject, m.body); err != nil {
+			log.Printf("error emailing %q: %v", m.subject, err)
+		}
+	}
+}
+
+// Close sends any queued emails.  Any later are dropped.
+func (n *Notifier) Close() {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+	<-n.done
+}
+
+func (n *Notifier) enqueue(subject, body string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	select {
+	case n.queue <- message{subject, body}:
+	default:
+		log.Printf("email queue full, dropping %q", subject)
+	}
+}
+
+// HandleEvent implements collector.EventSink, emailing alerts and noting
+// completed cycles for the digest.
+func (n *Notifier) HandleEvent(e collector.Event) {
+	switch e.Type {
+	case collector.EventOff:
+		if e.Cycle != nil {
+			n.mu.Lock()
+			d := n.device(e)
+			d.cycles++
+			d.onTime += e.Cycle.Duration
+			d.longestOn = max(d.longestOn, e.Cycle.Duration)
+			d.energyKwH += e.Cycle.EnergyKwH
+			n.mu.Unlock()
+		}
+	case collector.EventAlertFiring, collector.EventAlertResolved:
+		if e.Alert == nil {
+			return
+		}
+		if e.Type == collector.EventAlertFiring {
+			n.mu.Lock()
+			n.device(e).alertsSeen[e.Alert.Name] = true
+			n.mu.Unlock()
+		}
+		if *alerts {
+			n.enqueue(alertMessage(e))
+		}
+	}
+}
+
+// device returns the digest of e's device.  The caller must hold n.mu.
+func (n *Notifier) device(e collector.Event) *deviceDigest {
+	d, ok := n.devices[e.Device]
+	if !ok {
+		d = &deviceDigest{alertsSeen: map[string]bool{}}
+		n.devices[e.Device] = d
+	}
+	if e.Alias != "" {
+		d.alias = e.Alias
+	}
+	return d
+}
+
+func name(device, alias string) string {
+	if alias == "" {
+		return device
+	}
+	return fmt.Sprintf("%s (%s)", alias, device)
+}
+
+func alertMessage(e collector.Event) (subject, body string) {
+	state := "FIRING"
+	if e.Type == collector.EventAlertResolved {
+		state = "RESOLVED"
+	}
+	a := e.Alert
+	subject = fmt.Sprintf("[kasadutycycle] %s: %s %s", state, name(e.Device, e.Alias), a.Name)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Alert:    %s (%s)\n", a.Name, a.Severity)
+	fmt.Fprintf(&b, "State:    %s\n", state)
+	fmt.Fprintf(&b, "Device:   %s\n", name(e.Device, e.Alias))
+	if e.Addr != "" {
+		fmt.Fprintf(&b, "Address:  %s\n", e.Addr)
+	}
+	fmt.Fprintf(&b, "Since:    %s\n", a.Since.Format(time.RFC1123))
+	if !a.Resolved.IsZero() {
+		fmt.Fprintf(&b, "Resolved: %s\n", a.Resolved.Format(time.RFC1123))
+	}
+	if a.Detail != "" {
+		fmt.Fprintf(&b, "\n%s\n", a.Detail)
+	}
+	return subject, b.String()
+}
+
+// Digest sends the digest of activity since the last, and starts afresh.
+func (n *Notifier) Digest(now time.Time) {
+	n.mu.Lock()
+	since, devices := n.since, n.devices
+	n.since, n.devices = now, map[string]*deviceDigest{}
+	n.mu.Unlock()
+
+	// devices which haven't cycled at all are the most interesting
+	if n.collector != nil {
+		n.collector.Lock()
+		for id, m := range n.collector.Monitors {
+			d, ok := devices[id]
+			if !ok {
+				d = &deviceDigest{alertsSeen: map[string]bool{}}
+				devices[id] = d
+			}
+			if d.alias == "" {
+				d.alias = m.State.Alias
+			}
+		}
+		n.collector.Unlock()
+	}
+
+	ids := make([]string, 0, len(devices))
+	for id := range devices {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return name(ids[i], devices[ids[i]].alias) < name(ids[j], devices[ids[j]].alias)
+	})
+	period := now.Sub(since)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Cycles from %s to %s.\n", since.Format(time.RFC1123), now.Format(time.RFC1123))
+	if len(ids) == 0 {
+		fmt.Fprintf(&b, "\nNo devices are monitored.\n")
+	}
+	for _, id := range ids {
+		d := devices[id]
+		fmt.Fprintf(&b, "\n%s\n", name(id, d.alias))
+		fmt.Fprintf(&b, "  cycles:   %d, ON for %s (%.1f%%)\n",
+			d.cycles, d.onTime.Round(time.Second), 100*d.onTime.Seconds()/period.Seconds())
+		if d.cycles > 0 {
+			fmt.Fprintf(&b, "  ON phase: mean %s, longest %s\n",
+				(d.onTime / time.Duration(d.cycles)).Round(time.Second), d.longestOn.Round(time.Second))
+		}
+		if d.energyKwH > 0 {
+			fmt.Fprintf(&b, "  energy:   %.3f kWh\n", d.energyKwH)
+		}
+		if len(d.alertsSeen) > 0 {
+			var names []string
+			for a := range d.alertsSeen {
+				names = append(names, a)
+			}
+			sort.Strings(names)
+			fmt.Fprintf(&b, "  alerts:   %s\n", strings.Join(names, ", "))
+		}
+	}
+	n.enqueue("[kasadutycycle] daily digest", b.String())
+}
+
+// nextDigest returns the next time after now at -email-digest-time.
+func nextDigest(now time.Time) (time.Time, error) {
+	at, err := time.Parse("15:04", *digestAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad -email-digest-time %q: %w", *digestAt, err)
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next, nil
+}
+
+// Run sends the daily digest, if enabled, until shutdown.
+func (n *Notifier) Run(shutdown <-chan bool) {
+	if !*digest {
+		return
+	}
+	for {
+		next, err := nextDigest(n.time.Now())
+		if err != nil {
+			log.Printf("not sending email digests: %v", err)
+			return
+		}
+		t := n.time.NewTimer(next.Sub(n.time.Now()))
+		select {
+		case <-shutdown:
+			t.Stop()
+			return
+		case now := <-t.Chan():
+			n.Digest(now)
+		}
+	}
+}
+
+// send mails a single message to the recipients.
+func (n *Notifier) send(subject, body string) error {
+	host, _, err := net.SplitHostPort(n.server)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.Dial(n.server)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: *tlsInsecure}); err != nil {
+			return fmt.Errorf("starting TLS: %w", err)
+		}
+	} else if *startTLS {
+		return fmt.Errorf("%s doesn't offer STARTTLS", n.server)
+	}
+	if *username != "" {
+		if err := c.Auth(smtp.PlainAuth("", *username, n.password, host)); err != nil {
+			return fmt.Errorf("authenticating: %w", err)
+		}
+	}
+	if err := c.Mail(*from); err != nil {
+		return err
+	}
+	for _, rcpt := range n.to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", *from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,239 @@
+package email
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aqua/kasadutycycle/collector"
+	"github.com/jonboulle/clockwork"
+)
+
+// server is just enough of an SMTP server to accept mail, without TLS.
+type server struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	auth     string // decoded AUTH PLAIN response
+	rcpts    []string
+	messages []string
+}
+
+func (s *server) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+func newServer(t *testing.T) *server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	s := &server{l: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 localhost ESMTP test")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			b, _ := base64.StdEncoding.DecodeString(strings.Fields(line)[2])
+			s.mu.Lock()
+			s.auth = string(b)
+			s.mu.Unlock()
+			reply("235 ok")
+		case "MAIL":
+			reply("250 ok")
+		case "RCPT":
+			s.mu.Lock()
+			s.rcpts = append(s.rcpts, line)
+			s.mu.Unlock()
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func newNotifier(t *testing.T, s *server, c *collector.Collector, clock clockwork.Clock) *Notifier {
+	*to = "alice@example.com, bob@example.com"
+	*startTLS = false
+	t.Cleanup(func() { *to, *startTLS = "", true })
+	n, err := New(c, s.l.Addr().String(), clock)
+	if err != nil {
+		t.Fatalf("error creating notifier: %v", err)
+	}
+	return n
+}
+
+var start = time.Date(2024, 3, 12, 20, 0, 0, 0, time.UTC)
+
+func TestAlertEmail(t *testing.T) {
+	s := newServer(t)
+	*username = "kasa"
+	defer func() { *username = "" }()
+	n := newNotifier(t, s, nil, clockwork.NewFakeClockAt(start))
+	alert := &collector.Alert{Name: collector.AlertStuckOn, Severity: collector.SeverityCritical,
+		Firing: true, Since: start, Detail: "on for 3h0m0s, limit 2h0m0s"}
+	n.HandleEvent(collector.Event{Time: start, Device: "FFFF", Alias: "freezer", Type: collector.EventOff})
+	n.HandleEvent(collector.Event{Time: start, Device: "FFFF", Alias: "freezer", Type: collector.EventAlertFiring, Alert: alert})
+	n.Close()
+	// alerts arriving after Close are dropped
+	n.HandleEvent(collector.Event{Time: start, Device: "FFFF", Alias: "freezer", Type: collector.EventAlertFiring, Alert: alert})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) != 1 {
+		t.Fatalf("want 1 message, got %d", len(s.messages))
+	}
+	msg := s.messages[0]
+	for _, want := range []string{
+		"Subject: [kasadutycycle] FIRING: freezer (FFFF) stuck_on",
+		"To: alice@example.com, bob@example.com",
+		"on for 3h0m0s, limit 2h0m0s",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("want %q in message:\n%s", want, msg)
+		}
+	}
+	if want := "Date: " + start.Format(time.RFC1123Z); !strings.Contains(msg, want) {
+		t.Errorf("want %q in message:\n%s", want, msg)
+	}
+	if len(s.rcpts) != 2 {
+		t.Errorf("want 2 recipients, got %v", s.rcpts)
+	}
+	if s.auth != "\x00kasa\x00" {
+		t.Errorf("want PLAIN auth as kasa, got %q", s.auth)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	s := newServer(t)
+	clock := clockwork.NewFakeClockAt(start)
+	c := collector.New([]string{"127.0.0.2"}, "", clock)
+	c.MonitorAt("127.0.0.2").State.Alias = "fridge"
+	n := newNotifier(t, s, c, clock)
+	for i := 0; i < 3; i++ {
+		d := time.Duration(10+i) * time.Minute
+		n.HandleEvent(collector.Event{Time: start, Device: "FFFF", Alias: "freezer", Type: collector.EventOff,
+			Cycle: &collector.Cycle{On: true, Duration: d, EnergyKwH: 0.1}})
+	}
+	n.Digest(start.Add(24 * time.Hour))
+	n.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) != 1 {
+		t.Fatalf("want 1 message, got %d", len(s.messages))
+	}
+	for _, want := range []string{
+		"freezer (FFFF)",
+		"cycles:   3, ON for 33m0s (2.3%)",
+		"ON phase: mean 11m0s, longest 12m0s",
+		"energy:   0.300 kWh",
+		// which stopped cycling
+		"fridge (127.0.0.2)",
+		"cycles:   0, ON for 0s (0.0%)",
+	} {
+		if !strings.Contains(s.messages[0], want) {
+			t.Errorf("want %q in digest:\n%s", want, s.messages[0])
+		}
+	}
+}
+
+func TestRunDigest(t *testing.T) {
+	*digest = true
+	defer func() { *digest = false }()
+	s := newServer(t)
+	clock := clockwork.NewFakeClockAt(start)
+	n := newNotifier(t, s, nil, clock)
+	defer n.Close()
+	shutdown := make(chan bool)
+	go n.Run(shutdown)
+	defer close(shutdown)
+
+	// sent at 07:00, 11h after start
+	clock.BlockUntil(1)
+	clock.Advance(11*time.Hour - time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if s.count() != 0 {
+		t.Fatalf("want no digest before 07:00")
+	}
+	clock.Advance(time.Minute)
+	for deadline := time.Now().Add(5 * time.Second); s.count() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for digest")
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, want := range []string{
+		"Subject: [kasadutycycle] daily digest",
+		"Cycles from " + start.Format(time.RFC1123) + " to " + start.Add(11*time.Hour).Format(time.RFC1123),
+	} {
+		if !strings.Contains(s.messages[0], want) {
+			t.Errorf("want %q in digest:\n%s", want, s.messages[0])
+		}
+	}
+}
+
+func TestNextDigest(t *testing.T) {
+	for now, want := range map[time.Time]time.Time{
+		start:                      start.Add(11 * time.Hour),
+		start.Add(11 * time.Hour):  start.Add(35 * time.Hour),
+		start.Add(-14 * time.Hour): start.Add(-13 * time.Hour),
+	} {
+		if got, err := nextDigest(now); err != nil || !got.Equal(want) {
+			t.Errorf("want next digest after %s at %s, got %s (%v)", now, want, got, err)
+		}
+	}
+}
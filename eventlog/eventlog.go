@@ -0,0 +1,155 @@
+// Package eventlog writes collector events to an append-only JSON lines
+// file, rotating it as it grows.
+package eventlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+type Log struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	keep     int
+
+	f    *os.File
+	size int64
+}
+
+// Open opens (creating if need be) the log at path for appending.  Once it
+// exceeds maxBytes it is rotated to path.1 (and path.1 to path.2, and so
+// on), keeping at most keep rotated files.
+func Open(path string, maxBytes int64, keep int) (*Log, error) {
+	l := &Log{
+		path:     path,
+		maxBytes: maxBytes,
+		keep:     keep,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, st.Size()
+	return nil
+}
+
+func rotated(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	os.Remove(rotated(l.path, l.keep))
+	for n := l.keep - 1; n >= 1; n-- {
+		if err := os.Rename(rotated(l.path, n), rotated(l.path, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if l.keep > 0 {
+		if err := os.Rename(l.path, rotated(l.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Write appends e to the log, syncing it to disk.
+func (l *Log) Write(e collector.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotating %s: %w", l.path, err)
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// HandleEvent implements collector.EventSink.  Samples aren't logged.
+func (l *Log) HandleEvent(e collector.Event) {
+	if e.Type == collector.EventSample {
+		return
+	}
+	if err := l.Write(e); err != nil {
+		log.Printf("error writing event log %s: %v", l.path, err)
+	}
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// Read returns the events in the log at path, including its rotated
+// predecessors, oldest first.  Malformed lines (such as one cut short by a
+// crash) are skipped.
+func Read(path string) ([]collector.Event, error) {
+	var files []string
+	for n := 1; ; n++ {
+		if _, err := os.Stat(rotated(path, n)); err != nil {
+			break
+		}
+		files = append([]string{rotated(path, n)}, files...)
+	}
+	files = append(files, path)
+	var events []collector.Event
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			var e collector.Event
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				log.Printf("skipping malformed event in %s: %v", fn, err)
+				continue
+			}
+			events = append(events, e)
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
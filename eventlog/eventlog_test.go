@@ -0,0 +1,72 @@
+package eventlog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+func TestWriteRotateRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	l, err := Open(path, 300, 2)
+	if err != nil {
+		t.Fatalf("error opening log: %v", err)
+	}
+	start := time.Date(2024, 3, 12, 20, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		l.HandleEvent(collector.Event{
+			Time:            start.Add(time.Duration(i) * time.Minute),
+			Device:          "FFFF",
+			Type:            collector.EventOff,
+			Duration:        time.Duration(i) * time.Minute,
+			DurationSeconds: float64(i * 60),
+			Power:           0.5,
+		})
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("error closing log: %v", err)
+	}
+	if _, err := os.Stat(path + ".2"); err != nil {
+		t.Errorf("want two rotated files: %v", err)
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("want no more than two rotated files")
+	}
+
+	events, err := Read(path)
+	if err != nil {
+		t.Fatalf("error reading log: %v", err)
+	}
+	if len(events) == 0 || len(events) >= 10 {
+		t.Fatalf("want oldest events rotated away, got %d", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if !events[i].Time.After(events[i-1].Time) {
+			t.Errorf("want events in order, got %s after %s", events[i].Time, events[i-1].Time)
+		}
+	}
+	if last := events[len(events)-1]; last.Duration != 9*time.Minute || last.Device != "FFFF" {
+		t.Errorf("want final event intact, got %+v", last)
+	}
+
+	// durations are legible without knowing Go's units
+	b, _ := os.ReadFile(path)
+	if !strings.Contains(string(b), `"duration_seconds":540`) {
+		t.Errorf("want durations in seconds, got %s", b)
+	}
+
+	// reopening appends
+	l, err = Open(path, 300, 2)
+	if err != nil {
+		t.Fatalf("error reopening log: %v", err)
+	}
+	l.HandleEvent(collector.Event{Time: start.Add(time.Hour), Device: "FFFF", Type: collector.EventOn})
+	l.Close()
+	if again, _ := Read(path); len(again) == 0 || again[len(again)-1].Type != collector.EventOn {
+		t.Errorf("want appended event last, got %v", again)
+	}
+}
@@ -0,0 +1,100 @@
+package exporter
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aqua/kasadutycycle/alerting"
+)
+
+// SetAlerting makes the alert manager m available through the HTTP API.
+func (e *Exporter) SetAlerting(m *alerting.Manager) {
+	e.alerting = m
+}
+
+func (s *HttpServer) hasAlerting(w http.ResponseWriter) bool {
+	if s.alerting == nil {
+		http.Error(w, "no alert manager configured", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func (s *HttpServer) alerts(w http.ResponseWriter, r *http.Request) {
+	if !s.hasAlerting(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.alerting.Alerts())
+}
+
+func (s *HttpServer) silences(w http.ResponseWriter, r *http.Request) {
+	if !s.hasAlerting(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.alerting.Silences())
+}
+
+// silenceRequest is a Silence, whose end may instead be given as a
+// duration from its start.
+type silenceRequest struct {
+	alerting.Silence
+	Duration string `json:"duration,omitempty"`
+}
+
+func (s *HttpServer) addSilence(w http.ResponseWriter, r *http.Request) {
+	if !s.hasAlerting(w) {
+		return
+	}
+	var req silenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad silence: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			http.Error(w, "bad duration", http.StatusBadRequest)
+			return
+		}
+		if req.Starts.IsZero() {
+			req.Starts = s.alerting.Now()
+		}
+		req.Ends = req.Starts.Add(d)
+	}
+	if req.CreatedBy == "" {
+		req.CreatedBy = "api " + r.RemoteAddr
+	}
+	// resolve addresses and aliases of monitored devices to their IDs
+	if req.Device != "" {
+		if id, ok := s.collector.Identify(req.Device); ok {
+			req.Device = id.DeviceID
+		}
+	}
+	silence, err := s.alerting.AddSilence(req.Silence)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, alerting.ErrInvalidSilence) {
+			code = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	writeJSON(w, http.StatusCreated, silence)
+}
+
+func (s *HttpServer) deleteSilence(w http.ResponseWriter, r *http.Request) {
+	if !s.hasAlerting(w) {
+		return
+	}
+	if err := s.alerting.DeleteSilence(r.PathValue("id")); err != nil {
+		if errors.Is(err, alerting.ErrNoSuchSilence) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
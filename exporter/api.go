@@ -0,0 +1,178 @@
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aqua/kasadutycycle/collector"
+	"github.com/aqua/kasadutycycle/history"
+)
+
+// SetHistory makes the history store h available through the HTTP API.
+func (e *Exporter) SetHistory(h *history.Store) {
+	e.history = h
+}
+
+// parseTime accepts an RFC3339 timestamp, or a duration meaning that long
+// before now.
+func parseTime(v string, now time.Time) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// historyQuery holds the parameters common to history endpoints.
+type historyQuery struct {
+	device   string
+	from, to time.Time
+	limit    int
+}
+
+func (s *HttpServer) parseHistoryQuery(w http.ResponseWriter, r *http.Request) (*historyQuery, bool) {
+	if s.history == nil {
+		http.Error(w, "no history store configured", http.StatusNotFound)
+		return nil, false
+	}
+	q := &historyQuery{device: r.PathValue("id")}
+	// resolve addresses and aliases of monitored devices to their IDs
+	s.collector.Lock()
+	if m := s.collector.Lookup(q.device); m != nil {
+		q.device = m.ID()
+	}
+	s.collector.Unlock()
+	now := time.Now()
+	var err error
+	if q.from, err = parseTime(r.URL.Query().Get("from"), now); err != nil {
+		http.Error(w, fmt.Sprintf("bad from: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+	if q.to, err = parseTime(r.URL.Query().Get("to"), now); err != nil {
+		http.Error(w, fmt.Sprintf("bad to: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit < 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	return q, true
+}
+
+// cycleResponse describes a completed cycle.  Energy and peak power are
+// omitted if the samples they're derived from are no longer retained.
+type cycleResponse struct {
+	Device          string    `json:"device"`
+	Phase           string    `json:"phase"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	EnergyKwH       *float64  `json:"energy_kwh,omitempty"`
+	PeakPowerWatts  *float64  `json:"peak_power_watts,omitempty"`
+
+	// as measured at the time, for ON phases
+	Power *collector.PowerStats `json:"power,omitempty"`
+}
+
+// cycles lists a device's completed cycles, newest first, optionally
+// restricted to ?phase=on or ?phase=off.  The limit defaults to 100.
+func (s *HttpServer) cycles(w http.ResponseWriter, r *http.Request) {
+	q, ok := s.parseHistoryQuery(w, r)
+	if !ok {
+		return
+	}
+	f := history.CycleFilter{From: q.from, To: q.to, Limit: q.limit}
+	if f.Limit == 0 {
+		f.Limit = 100
+	}
+	switch r.URL.Query().Get("phase") {
+	case "":
+	case "on":
+		f.On = true
+	case "off":
+		f.Off = true
+	default:
+		http.Error(w, "bad phase", http.StatusBadRequest)
+		return
+	}
+	cycles, err := s.history.Cycles(q.device, f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := make([]cycleResponse, 0, len(cycles))
+	for _, c := range cycles {
+		cr := cycleResponse{
+			Device:          c.Device,
+			Phase:           "off",
+			Start:           c.Start,
+			End:             c.End,
+			DurationSeconds: c.Duration.Seconds(),
+		}
+		if c.On {
+			cr.Phase = "on"
+		}
+		if energy, peak, ok := s.history.CycleStats(q.device, c); ok {
+			cr.EnergyKwH, cr.PeakPowerWatts = &energy, &peak
+		}
+		// as measured at the time, which may be better than the samples
+		if c.EnergyKwH > 0 {
+			energy := c.EnergyKwH
+			cr.EnergyKwH = &energy
+		}
+		if c.Power != nil {
+			peak := c.Power.PeakWatts
+			cr.PeakPowerWatts, cr.Power = &peak, c.Power
+		}
+		resp = append(resp, cr)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *HttpServer) samples(w http.ResponseWriter, r *http.Request) {
+	q, ok := s.parseHistoryQuery(w, r)
+	if !ok {
+		return
+	}
+	samples, err := s.history.Samples(q.device, q.from, q.to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if q.limit > 0 && len(samples) > q.limit {
+		samples = samples[len(samples)-q.limit:]
+	}
+	writeJSON(w, http.StatusOK, samples)
+}
+
+func (s *HttpServer) rollups(w http.ResponseWriter, r *http.Request) {
+	q, ok := s.parseHistoryQuery(w, r)
+	if !ok {
+		return
+	}
+	rollups, err := s.history.Rollups(q.device, q.from, q.to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, rollups)
+}
+
+func (s *HttpServer) events(w http.ResponseWriter, r *http.Request) {
+	q, ok := s.parseHistoryQuery(w, r)
+	if !ok {
+		return
+	}
+	events, err := s.history.Events(q.device, q.from, q.to, q.limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
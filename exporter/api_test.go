@@ -0,0 +1,150 @@
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aqua/kasadutycycle/alerting"
+	"github.com/aqua/kasadutycycle/collector"
+	"github.com/aqua/kasadutycycle/history"
+	"github.com/jonboulle/clockwork"
+)
+
+func newTestServer(t *testing.T) (*HttpServer, *history.Store) {
+	c := collector.New(nil, "", clockwork.NewFakeClock())
+	e := New(c)
+	h, err := history.Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("error opening history: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	e.SetHistory(h)
+	am, err := alerting.New(alerting.Config{}, filepath.Join(t.TempDir(), "silences.json"), clockwork.NewRealClock())
+	if err != nil {
+		t.Fatalf("error creating alert manager: %v", err)
+	}
+	e.SetAlerting(am)
+	return e.NewHttpServer(), h
+}
+
+func get(t *testing.T, s http.Handler, url string, v interface{}) int {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	if w.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("error decoding %s: %v", url, err)
+		}
+	}
+	return w.Code
+}
+
+func TestCycles(t *testing.T) {
+	s, h := newTestServer(t)
+	start := time.Date(2024, 3, 12, 20, 0, 0, 0, time.UTC)
+	kwh := 1.0
+	for i := 0; i < 60; i++ {
+		now := start.Add(time.Duration(i) * time.Minute)
+		on := (i/10)%2 == 0
+		power := 0.5
+		if on {
+			power = 90 + float64(i)
+			kwh += 0.0015
+		}
+		h.AddSample("FFFF", now, collector.Sample{Power: power, On: on, TotalKwH: kwh})
+		if i > 0 && i%10 == 0 {
+			h.AddCycle("FFFF", collector.Cycle{
+				On:       !on,
+				Start:    now.Add(-10 * time.Minute),
+				End:      now,
+				Duration: 10 * time.Minute,
+			})
+		}
+	}
+
+	var all []cycleResponse
+	if code := get(t, s, "/api/devices/FFFF/cycles", &all); code != http.StatusOK {
+		t.Fatalf("want 200, got %d", code)
+	}
+	if len(all) != 5 || all[0].Start != start.Add(40*time.Minute) {
+		t.Fatalf("want 5 cycles, newest first, got %v", all)
+	}
+
+	var on []cycleResponse
+	get(t, s, "/api/devices/FFFF/cycles?phase=on&limit=2", &on)
+	if len(on) != 2 || on[0].Phase != "on" || on[0].DurationSeconds != 600 {
+		t.Fatalf("want 2 on cycles of 600s, got %v", on)
+	}
+	// the 20:40-20:50 run peaked at 139w at 20:49 and 20:50 reads off
+	if on[0].PeakPowerWatts == nil || *on[0].PeakPowerWatts != 139 {
+		t.Errorf("want peak of 139w, got %v", on[0].PeakPowerWatts)
+	}
+	if on[0].EnergyKwH == nil || *on[0].EnergyKwH < 0.0134 || *on[0].EnergyKwH > 0.0136 {
+		t.Errorf("want energy of 0.0135kWh, got %v", on[0].EnergyKwH)
+	}
+
+	var ranged []cycleResponse
+	get(t, s, "/api/devices/FFFF/cycles?from=2024-03-12T20:15:00Z&to=2024-03-12T20:35:00Z", &ranged)
+	if len(ranged) != 2 {
+		t.Errorf("want 2 cycles starting 20:15-20:35, got %v", ranged)
+	}
+
+	if code := get(t, s, "/api/devices/FFFF/cycles?phase=sideways", nil); code != http.StatusBadRequest {
+		t.Errorf("want 400 for bad phase, got %d", code)
+	}
+}
+
+func TestSilencesAPI(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.controlToken = "sekrit"
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/silences", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer sekrit")
+		s.ServeHTTP(w, r)
+		return w
+	}
+	if w := post(`{"device": "FFFF", "duration": "-1h"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("want 400 for silence ending before it starts, got %d", w.Code)
+	}
+	w := post(`{"device": "FFFF", "alert": "stuck_off", "duration": "48h", "comment": "defrosting"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("want 201, got %d: %s", w.Code, w.Body)
+	}
+	var created alerting.Silence
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("error decoding silence: %v", err)
+	}
+	if created.ID == "" || created.Ends.Sub(created.Starts) != 48*time.Hour {
+		t.Errorf("unexpected silence %+v", created)
+	}
+
+	var silences []alerting.Silence
+	if code := get(t, s, "/api/silences", &silences); code != http.StatusOK || len(silences) != 1 || silences[0].ID != created.ID {
+		t.Errorf("want created silence listed, got %d %+v", code, silences)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("DELETE", "/api/silences/"+created.ID, nil)
+	r.Header.Set("Authorization", "Bearer sekrit")
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("want 204 deleting silence, got %d", w.Code)
+	}
+	if code := get(t, s, "/api/silences", &silences); code != http.StatusOK || len(silences) != 0 {
+		t.Errorf("want no silences, got %d %+v", code, silences)
+	}
+
+	unsaved, err := alerting.New(alerting.Config{}, filepath.Join(t.TempDir(), "missing", "silences.json"), clockwork.NewRealClock())
+	if err != nil {
+		t.Fatalf("error creating alert manager: %v", err)
+	}
+	s.alerting = unsaved
+	if w := post(`{"device": "FFFF", "duration": "1h"}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("want 500 when the silence can't be saved, got %d", w.Code)
+	}
+}
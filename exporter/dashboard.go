@@ -0,0 +1,93 @@
+package exporter
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// dashboard serves a page listing the devices, updated live from
+// /api/devices and /api/stream.
+func (s *HttpServer) dashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+// deviceResponse describes a device's current state.
+type deviceResponse struct {
+	collector.Identity
+	Online                 bool                   `json:"online"`
+	Metering               bool                   `json:"metering"`
+	Running                bool                   `json:"running"`
+	Unpowered              bool                   `json:"unpowered"`
+	Tripped                bool                   `json:"tripped"`
+	Shed                   bool                   `json:"shed"`
+	RelayState             bool                   `json:"relay_state"`
+	Since                  *time.Time             `json:"since,omitempty"`
+	InStateSeconds         float64                `json:"in_state_seconds"`
+	PowerWatts             float64                `json:"power_watts"`
+	LastSample             time.Time              `json:"last_sample"`
+	CycleCount             uint                   `json:"cycle_count"`
+	LastOnDurationSeconds  float64                `json:"last_on_duration_seconds"`
+	LastOffDurationSeconds float64                `json:"last_off_duration_seconds"`
+	LastOnEnergyKwH        float64                `json:"last_on_energy_kwh,omitempty"`
+	DutyPercent            map[string]float64     `json:"duty_percent"`
+	Alerts                 []collector.Alert      `json:"alerts"`
+	Timeline               []collector.Transition `json:"timeline"`
+}
+
+// devices lists the monitored devices and their current state, ordered by
+// alias.  The timeline holds the transitions retained for duty cycle
+// computation, oldest first.
+func (s *HttpServer) devices(w http.ResponseWriter, r *http.Request) {
+	now := s.collector.Now()
+	s.collector.Lock()
+	resp := make([]deviceResponse, 0, len(s.collector.Monitors))
+	for _, m := range s.collector.Monitors {
+		st := &m.State
+		d := deviceResponse{
+			Identity:               m.Identity(),
+			Online:                 m.Online(),
+			Metering:               st.Metering,
+			Running:                st.CycleState,
+			Unpowered:              st.Unpowered,
+			Tripped:                st.Tripped,
+			Shed:                   st.Shed,
+			RelayState:             st.RelayState,
+			PowerWatts:             st.Power,
+			LastSample:             st.Timestamp,
+			CycleCount:             st.CycleCount,
+			LastOnDurationSeconds:  st.LastOnDuration.Seconds(),
+			LastOffDurationSeconds: st.LastOffDuration.Seconds(),
+			LastOnEnergyKwH:        st.LastOnEnergyKwH,
+			DutyPercent:            map[string]float64{},
+			Alerts:                 append([]collector.Alert{}, st.FiringAlerts()...),
+			Timeline:               append([]collector.Transition{}, st.Transitions...),
+		}
+		if n := len(st.Transitions); n > 0 {
+			since := st.Transitions[n-1].Time
+			d.Since = &since
+			d.InStateSeconds = now.Sub(since).Seconds()
+		}
+		for _, w := range collector.DutyWindows() {
+			if frac, observed := st.Duty(now, w); observed > 0 {
+				d.DutyPercent[windowLabel(w)] = frac * 100
+			}
+		}
+		resp = append(resp, d)
+	}
+	s.collector.Unlock()
+	sort.Slice(resp, func(i, j int) bool {
+		if resp[i].Alias != resp[j].Alias {
+			return resp[i].Alias < resp[j].Alias
+		}
+		return resp[i].DeviceID < resp[j].DeviceID
+	})
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,69 @@
+package exporter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aqua/kasadutycycle/collector"
+	"github.com/jonboulle/clockwork"
+)
+
+func TestDevices(t *testing.T) {
+	now := time.Date(2024, 3, 12, 20, 0, 0, 0, time.UTC)
+	c := collector.New([]string{"127.0.0.2", "127.0.0.1"}, "", clockwork.NewFakeClockAt(now))
+	m := c.MonitorAt("127.0.0.1")
+	m.State.Alias, m.State.DeviceID = "freezer", "FFFF"
+	m.State.Timestamp, m.State.Metering, m.State.Power = now, true, 92.5
+	m.State.CycleState, m.State.CycleCount = true, 3
+	m.State.LastOffDuration = 20 * time.Minute
+	m.State.Transitions = []collector.Transition{
+		{Time: now.Add(-2 * time.Hour), On: false},
+		{Time: now.Add(-45 * time.Minute), On: true},
+		{Time: now.Add(-30 * time.Minute), On: false},
+		{Time: now.Add(-10 * time.Minute), On: true},
+	}
+	m.State.Alerts = map[string]collector.Alert{
+		collector.AlertStuckOn: {Name: collector.AlertStuckOn, Firing: true},
+	}
+	c.MonitorAt("127.0.0.2").State.Alias = "fridge"
+	s := New(c).NewHttpServer()
+
+	var got []deviceResponse
+	if code := get(t, s, "/api/devices", &got); code != http.StatusOK {
+		t.Fatalf("want 200, got %d", code)
+	}
+	if len(got) != 2 || got[0].Alias != "freezer" || got[1].Alias != "fridge" {
+		t.Fatalf("want freezer and fridge, got %+v", got)
+	}
+	d := got[0]
+	if !d.Running || d.PowerWatts != 92.5 || d.CycleCount != 3 || d.LastOffDurationSeconds != 1200 {
+		t.Errorf("want freezer running at 92.5w, got %+v", d)
+	}
+	if d.InStateSeconds != 600 || d.Since == nil || !d.Since.Equal(now.Add(-10*time.Minute)) {
+		t.Errorf("want on for 10m, got %fs since %v", d.InStateSeconds, d.Since)
+	}
+	// 25m on in the last hour
+	if v := d.DutyPercent["1h"]; v < 41.6 || v > 41.7 {
+		t.Errorf("want 41.7%% over 1h, got %v", d.DutyPercent)
+	}
+	if len(d.Timeline) != 4 || len(d.Alerts) != 1 || d.Alerts[0].Name != collector.AlertStuckOn {
+		t.Errorf("want timeline and firing alert, got %v, %v", d.Timeline, d.Alerts)
+	}
+	if got[1].Alerts == nil || len(got[1].DutyPercent) != 0 || got[1].Since != nil {
+		t.Errorf("want no alerts, duty or transition for fridge, got %+v", got[1])
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "api/stream") {
+		t.Errorf("want dashboard, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/nonexistent", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("want 404 for other paths, got %d", w.Code)
+	}
+}
@@ -3,14 +3,19 @@ package exporter
 import (
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/aqua/kasadutycycle/alerting"
 	"github.com/aqua/kasadutycycle/collector"
+	"github.com/aqua/kasadutycycle/history"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Exporter struct {
 	collector *collector.Collector
+	history   *history.Store
+	alerting  *alerting.Manager
 	registry  *prometheus.Registry
 
 	onlineMetric,
@@ -20,13 +25,26 @@ type Exporter struct {
 	powerMetric,
 	totalPowerMetric,
 	currentStateMetric,
+	relayStateMetric,
 	currentOnDurationMetric,
 	currentOffDurationMetric,
 	lastOnDurationMetric,
 	lastOffDurationMetric,
-	cycleCountMetric *prometheus.Desc
+	cycleCountMetric,
+	protectionTrippedMetric,
+	protectionTripsMetric,
+	loadShedMetric,
+	combinedPowerMetric,
+	dutyPercentMetric,
+	lastOnEnergyMetric,
+	lastOnPowerMetric,
+	anomalyScoreMetric,
+	baselineDurationMetric,
+	anomaliesMetric,
+	alertFiringMetric *prometheus.Desc
 
-	cycleDurationMetric prometheus.Histogram
+	cycleDurationMetric,
+	cycleEnergyMetric prometheus.Histogram
 
 	/*
 		dutyThresholdMetric *prometheus.GaugeVec
@@ -84,7 +102,12 @@ func New(c *collector.Collector) *Exporter {
 			nil),
 		currentStateMetric: prometheus.NewDesc(
 			"current_duty_state",
-			"Current state of the duty cycle (1 for on, 0 for off).",
+			"Current state of the duty cycle (1 for on, 0 for off, -1 for unpowered).",
+			[]string{"addr", "mac", "model", "alias", "device_id"},
+			nil),
+		relayStateMetric: prometheus.NewDesc(
+			"relay_state",
+			"State of the plug's relay (1 for on, 0 for off).",
 			[]string{"addr", "mac", "model", "alias", "device_id"},
 			nil),
 		currentOnDurationMetric: prometheus.NewDesc(
@@ -112,16 +135,95 @@ func New(c *collector.Collector) *Exporter {
 			"Full duty cycles observed",
 			[]string{"addr", "mac", "model", "alias", "device_id"},
 			nil),
+		protectionTrippedMetric: prometheus.NewDesc(
+			"protection_tripped",
+			"If runtime protection has switched the plug off (1) or not (0).",
+			[]string{"addr", "mac", "model", "alias", "device_id"},
+			nil),
+		protectionTripsMetric: prometheus.NewDesc(
+			"protection_trips",
+			"Times runtime protection has switched the plug off.",
+			[]string{"addr", "mac", "model", "alias", "device_id"},
+			nil),
+		loadShedMetric: prometheus.NewDesc(
+			"load_shed",
+			"If load shedding has switched the plug off (1) or not (0).",
+			[]string{"addr", "mac", "model", "alias", "device_id"},
+			nil),
+		combinedPowerMetric: prometheus.NewDesc(
+			"combined_power_watts",
+			"Sum of instantaneous power (watts) across all plugs, as used for load shedding.",
+			nil,
+			nil),
+		dutyPercentMetric: prometheus.NewDesc(
+			"duty_cycle_percent",
+			"Percentage of the trailing window during which the circuit was ON (excluding time unpowered or unobserved).",
+			[]string{"addr", "mac", "model", "alias", "device_id", "window"},
+			nil),
+		lastOnEnergyMetric: prometheus.NewDesc(
+			"last_on_energy_kwh",
+			"Energy (in kWh) used during the circuit's most recent full ON duty state.",
+			[]string{"addr", "mac", "model", "alias", "device_id"},
+			nil),
+		lastOnPowerMetric: prometheus.NewDesc(
+			"last_on_power_watts",
+			"Power (watts) drawn during the circuit's most recent full ON duty state: peak, mean, min, or inrush (first sample).",
+			[]string{"addr", "mac", "model", "alias", "device_id", "stat"},
+			nil),
+		anomalyScoreMetric: prometheus.NewDesc(
+			"cycle_anomaly_score",
+			"Standard deviations by which the most recent ON or OFF duty state's duration differed from the learned baseline.",
+			[]string{"addr", "mac", "model", "alias", "device_id", "phase"},
+			nil),
+		baselineDurationMetric: prometheus.NewDesc(
+			"cycle_baseline_duration_seconds",
+			"Learned (exponentially-weighted) mean duration, in seconds, of ON or OFF duty states.",
+			[]string{"addr", "mac", "model", "alias", "device_id", "phase"},
+			nil),
+		anomaliesMetric: prometheus.NewDesc(
+			"cycle_anomalies",
+			"ON or OFF duty states whose duration was anomalous relative to the learned baseline.",
+			[]string{"addr", "mac", "model", "alias", "device_id"},
+			nil),
+		alertFiringMetric: prometheus.NewDesc(
+			"alert_firing",
+			"If the device's built-in alert rule is firing (1) or not (0).",
+			[]string{"addr", "mac", "model", "alias", "device_id", "alertname", "severity"},
+			nil),
 		cycleDurationMetric: prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name:    "cycle_durations",
 			Help:    "Duration (in seconds) of observed duty cycles",
 			Buckets: prometheus.LinearBuckets(0, 60, 60),
 		}),
+		cycleEnergyMetric: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "cycle_energy_kwh",
+			Help:    "Energy (in kWh) used during observed ON duty states",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
 	}
 	e.registry.MustRegister(e.cycleDurationMetric)
+	e.registry.MustRegister(e.cycleEnergyMetric)
 	return e
 }
 
+// windowLabel formats a duration compactly, as "6h" rather than "6h0m0s".
+func windowLabel(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// Register adds further metrics, such as those of notifiers, to those
+// served.
+func (e *Exporter) Register(cs ...prometheus.Collector) {
+	e.registry.MustRegister(cs...)
+}
+
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.onlineMetric
 	ch <- e.dutyThresholdMetric
@@ -130,11 +232,23 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.powerMetric
 	ch <- e.totalPowerMetric
 	ch <- e.currentStateMetric
+	ch <- e.relayStateMetric
 	ch <- e.currentOnDurationMetric
 	ch <- e.currentOffDurationMetric
 	ch <- e.lastOnDurationMetric
 	ch <- e.lastOffDurationMetric
 	ch <- e.cycleCountMetric
+	ch <- e.protectionTrippedMetric
+	ch <- e.protectionTripsMetric
+	ch <- e.loadShedMetric
+	ch <- e.combinedPowerMetric
+	ch <- e.dutyPercentMetric
+	ch <- e.lastOnEnergyMetric
+	ch <- e.lastOnPowerMetric
+	ch <- e.anomalyScoreMetric
+	ch <- e.baselineDurationMetric
+	ch <- e.anomaliesMetric
+	ch <- e.alertFiringMetric
 	/*
 		e.registry.MustRegister(
 			e.dutyThresholdMetric,
@@ -155,33 +269,55 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 
 	onlinePlugs := 0
 
-	for ID, m := range e.collector.Monitors {
+	e.collector.Lock()
+	defer e.collector.Unlock()
+	for _, m := range e.collector.Monitors {
 		if m.State.Timestamp.IsZero() {
 			continue
 		}
 		onlinePlugs++
-		ch <- prometheus.MustNewConstMetric(
-			e.dutyThresholdMetric, prometheus.GaugeValue,
-			float64(m.ThresholdWatts),
-			ID, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
-		ch <- prometheus.MustNewConstMetric(
-			e.voltageMetric, prometheus.GaugeValue,
-			float64(m.State.Voltage),
-			ID, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
-		ch <- prometheus.MustNewConstMetric(
-			e.currentMetric, prometheus.GaugeValue,
-			float64(m.State.Current),
-			ID, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
-		ch <- prometheus.MustNewConstMetric(
-			e.powerMetric, prometheus.GaugeValue,
-			float64(m.State.Power),
-			ID, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
-		ch <- prometheus.MustNewConstMetric(
-			e.totalPowerMetric, prometheus.GaugeValue,
-			float64(m.State.TotalKwH),
-			ID, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+		// plugs without an energy meter have no readings to export
+		if m.State.Metering {
+			ch <- prometheus.MustNewConstMetric(
+				e.dutyThresholdMetric, prometheus.GaugeValue,
+				float64(m.ThresholdWatts),
+				m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+			ch <- prometheus.MustNewConstMetric(
+				e.voltageMetric, prometheus.GaugeValue,
+				float64(m.State.Voltage),
+				m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+			ch <- prometheus.MustNewConstMetric(
+				e.currentMetric, prometheus.GaugeValue,
+				float64(m.State.Current),
+				m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+			ch <- prometheus.MustNewConstMetric(
+				e.powerMetric, prometheus.GaugeValue,
+				float64(m.State.Power),
+				m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+			ch <- prometheus.MustNewConstMetric(
+				e.totalPowerMetric, prometheus.GaugeValue,
+				float64(m.State.TotalKwH),
+				m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+			ch <- prometheus.MustNewConstMetric(
+				e.lastOnEnergyMetric, prometheus.GaugeValue,
+				m.State.LastOnEnergyKwH,
+				m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+			for stat, v := range map[string]float64{
+				"peak":   m.State.LastOnPower.PeakWatts,
+				"mean":   m.State.LastOnPower.MeanWatts,
+				"min":    m.State.LastOnPower.MinWatts,
+				"inrush": m.State.LastOnPower.InrushWatts,
+			} {
+				ch <- prometheus.MustNewConstMetric(
+					e.lastOnPowerMetric, prometheus.GaugeValue,
+					v,
+					m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID, stat)
+			}
+		}
 		var currentState, onDuration, offDuration float64
-		if m.State.CycleState {
+		if m.State.Unpowered {
+			currentState, onDuration, offDuration = -1, 0, 0
+		} else if m.State.CycleState {
 			currentState, onDuration, offDuration = 1, float64(now.Sub(m.State.LastOn).Seconds()), 0
 			log.Printf("onDuration = %v", now.Sub(m.State.LastOn).Seconds())
 		} else {
@@ -190,34 +326,112 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 		ch <- prometheus.MustNewConstMetric(
 			e.currentStateMetric, prometheus.GaugeValue,
 			currentState,
-			ID, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+			m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+		var relayState float64
+		if m.State.RelayState {
+			relayState = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.relayStateMetric, prometheus.GaugeValue,
+			relayState,
+			m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
 		ch <- prometheus.MustNewConstMetric(
 			e.currentOnDurationMetric, prometheus.GaugeValue,
 			onDuration,
-			ID, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+			m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
 		ch <- prometheus.MustNewConstMetric(
 			e.currentOffDurationMetric, prometheus.GaugeValue,
 			offDuration,
-			ID, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+			m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
 		ch <- prometheus.MustNewConstMetric(
 			e.lastOnDurationMetric, prometheus.GaugeValue,
 			float64(m.State.LastOnDuration.Seconds()),
-			ID, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+			m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
 		ch <- prometheus.MustNewConstMetric(
 			e.lastOffDurationMetric, prometheus.GaugeValue,
 			float64(m.State.LastOffDuration.Seconds()),
-			ID, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+			m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
 		ch <- prometheus.MustNewConstMetric(
 			e.cycleCountMetric, prometheus.CounterValue,
 			float64(m.State.CycleCount),
-			ID, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+			m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+		var tripped float64
+		if m.State.Tripped {
+			tripped = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.protectionTrippedMetric, prometheus.GaugeValue,
+			tripped,
+			m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+		ch <- prometheus.MustNewConstMetric(
+			e.protectionTripsMetric, prometheus.CounterValue,
+			float64(m.State.ProtectionTrips),
+			m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+		var shed float64
+		if m.State.Shed {
+			shed = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.loadShedMetric, prometheus.GaugeValue,
+			shed,
+			m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+		for phase, b := range map[string]struct {
+			score    float64
+			baseline collector.Baseline
+		}{
+			"on":  {m.State.OnAnomalyScore, m.State.OnBaseline},
+			"off": {m.State.OffAnomalyScore, m.State.OffBaseline},
+		} {
+			if b.baseline.Count == 0 {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(
+				e.anomalyScoreMetric, prometheus.GaugeValue,
+				b.score,
+				m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID, phase)
+			ch <- prometheus.MustNewConstMetric(
+				e.baselineDurationMetric, prometheus.GaugeValue,
+				b.baseline.Mean,
+				m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID, phase)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.anomaliesMetric, prometheus.CounterValue,
+			float64(m.State.AnomalyCount),
+			m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID)
+		for _, a := range m.State.Alerts {
+			var firing float64
+			if a.Firing {
+				firing = 1
+			}
+			ch <- prometheus.MustNewConstMetric(
+				e.alertFiringMetric, prometheus.GaugeValue,
+				firing,
+				m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID, a.Name, a.Severity)
+		}
+		for _, w := range collector.DutyWindows() {
+			frac, observed := m.State.Duty(now, w)
+			if observed == 0 {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(
+				e.dutyPercentMetric, prometheus.GaugeValue,
+				frac*100,
+				m.Addr, m.State.MAC, m.State.Model, m.State.Alias, m.State.DeviceID, windowLabel(w))
+		}
 		for _, v := range m.State.CycleDurations {
 			log.Printf("flushing histogram observation of cycle lasting %s", v)
 			e.cycleDurationMetric.Observe(float64(v.Seconds()))
 		}
 		m.State.CycleDurations = nil
+		for _, v := range m.State.CycleEnergies {
+			e.cycleEnergyMetric.Observe(v)
+		}
+		m.State.CycleEnergies = nil
 	}
 	ch <- prometheus.MustNewConstMetric(
 		e.onlineMetric, prometheus.GaugeValue,
 		float64(onlinePlugs))
+	ch <- prometheus.MustNewConstMetric(
+		e.combinedPowerMetric, prometheus.GaugeValue,
+		e.collector.TotalPower())
 }
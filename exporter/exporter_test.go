@@ -0,0 +1,62 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aqua/kasadutycycle/collector"
+	"github.com/jonboulle/clockwork"
+)
+
+func TestWindowLabel(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		time.Hour:        "1h",
+		24 * time.Hour:   "24h",
+		30 * time.Minute: "30m",
+		90 * time.Minute: "1h30m",
+		45 * time.Second: "45s",
+	} {
+		if got := windowLabel(d); got != want {
+			t.Errorf("want %q for %s, got %q", want, d, got)
+		}
+	}
+}
+
+func TestDutyPercentMetric(t *testing.T) {
+	c := collector.New([]string{"127.0.0.1"}, "", clockwork.NewFakeClock())
+	m := c.MonitorAt("127.0.0.1")
+	now := time.Now()
+	m.State.Timestamp = now
+	m.State.Metering = true
+	m.State.Transitions = []collector.Transition{
+		{Time: now.Add(-2 * time.Hour), On: false},
+		{Time: now.Add(-45 * time.Minute), On: true},
+		{Time: now.Add(-30 * time.Minute), On: false},
+	}
+	e := New(c)
+	e.registry.MustRegister(e)
+	families, err := e.registry.Gather()
+	if err != nil {
+		t.Fatalf("error gathering: %v", err)
+	}
+	got := map[string]float64{}
+	for _, f := range families {
+		if f.GetName() != "duty_cycle_percent" {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == "window" {
+					got[l.GetValue()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	// 15m on in the last hour, and in the 2h observed of the last 6h
+	if v := got["1h"]; v < 24.9 || v > 25.1 {
+		t.Errorf("want 25%% over 1h, got %f", v)
+	}
+	if v := got["6h"]; v < 12.4 || v > 12.6 {
+		t.Errorf("want 12.5%% over 6h, got %f", v)
+	}
+}
@@ -1,25 +1,148 @@
 package exporter
 
 import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/aqua/kasadutycycle/alerting"
+	"github.com/aqua/kasadutycycle/collector"
+	"github.com/aqua/kasadutycycle/history"
 	// "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+var controlTokenFile = flag.String("control-token-file", "", "File holding the bearer token required by relay control and silence endpoints (control is disabled if unset)")
+
 type HttpServer struct {
-	mux *http.ServeMux
+	mux          *http.ServeMux
+	collector    *collector.Collector
+	history      *history.Store
+	alerting     *alerting.Manager
+	controlToken string
 }
 
 func (e *Exporter) NewHttpServer() *HttpServer {
 	s := &HttpServer{
-		mux: http.NewServeMux(),
+		mux:       http.NewServeMux(),
+		collector: e.collector,
+		history:   e.history,
+		alerting:  e.alerting,
+	}
+	if *controlTokenFile != "" {
+		b, err := os.ReadFile(*controlTokenFile)
+		if err != nil {
+			log.Fatalf("error reading control token: %v", err)
+		}
+		s.controlToken = strings.TrimSpace(string(b))
 	}
 	e.registry.MustRegister(e)
 	s.mux.HandleFunc("/metrics", promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{}).ServeHTTP)
+	s.mux.HandleFunc("POST /api/devices/{id}/relay/on", s.authorized(s.relayOn))
+	s.mux.HandleFunc("POST /api/devices/{id}/relay/off", s.authorized(s.relayOff))
+	s.mux.HandleFunc("POST /api/devices/{id}/relay/cycle", s.authorized(s.relayCycle))
+	s.mux.HandleFunc("GET /api/devices/{id}/cycles", s.cycles)
+	s.mux.HandleFunc("GET /api/devices/{id}/samples", s.samples)
+	s.mux.HandleFunc("GET /api/devices/{id}/rollups", s.rollups)
+	s.mux.HandleFunc("GET /api/devices/{id}/events", s.events)
+	s.mux.HandleFunc("GET /{$}", s.dashboard)
+	s.mux.HandleFunc("GET /api/devices", s.devices)
+	s.mux.HandleFunc("GET /api/stream", s.stream)
+	s.mux.HandleFunc("GET /api/alerts", s.alerts)
+	s.mux.HandleFunc("GET /api/silences", s.silences)
+	s.mux.HandleFunc("POST /api/silences", s.authorized(s.addSilence))
+	s.mux.HandleFunc("DELETE /api/silences/{id}", s.authorized(s.deleteSilence))
 	return s
 }
 
 func (s *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
+
+// authorized wraps a handler, requiring the control token as a bearer token.
+func (s *HttpServer) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.controlToken == "" {
+			http.Error(w, "control is disabled", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.controlToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, collector.ErrNoSuchDevice) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+type relayResponse struct {
+	Device     string `json:"device"`
+	RelayState bool   `json:"relay_state"`
+}
+
+func (s *HttpServer) setRelay(w http.ResponseWriter, r *http.Request, on bool) {
+	id := r.PathValue("id")
+	if err := s.collector.SetRelay(id, on, "api "+r.RemoteAddr); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, relayResponse{Device: id, RelayState: on})
+}
+
+func (s *HttpServer) relayOn(w http.ResponseWriter, r *http.Request) {
+	s.setRelay(w, r, true)
+}
+
+func (s *HttpServer) relayOff(w http.ResponseWriter, r *http.Request) {
+	s.setRelay(w, r, false)
+}
+
+// maxPowerCycleDelay bounds how long a power cycle may leave a device off.
+const maxPowerCycleDelay = 15 * time.Minute
+
+// relayCycle switches a relay off, and back on after ?delay= (default 10s).
+func (s *HttpServer) relayCycle(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	delay := 10 * time.Second
+	if v := r.URL.Query().Get("delay"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "bad delay", http.StatusBadRequest)
+			return
+		}
+		if d > maxPowerCycleDelay {
+			http.Error(w, fmt.Sprintf("delay exceeds %s", maxPowerCycleDelay), http.StatusBadRequest)
+			return
+		}
+		delay = d
+	}
+	if err := s.collector.PowerCycle(id, delay, "api "+r.RemoteAddr); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, relayResponse{Device: id, RelayState: false})
+}
@@ -0,0 +1,52 @@
+package exporter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aqua/kasadutycycle/collector"
+	"github.com/jonboulle/clockwork"
+)
+
+func TestRelayControlRequiresToken(t *testing.T) {
+	s := New(collector.New(nil, "", clockwork.NewFakeClock())).NewHttpServer()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/api/devices/FFFF/relay/off", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("want 403 with control disabled, got %d", w.Code)
+	}
+	s.controlToken = "sekrit"
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/devices/FFFF/relay/off", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("want 401 with wrong token, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	r.Header.Set("Authorization", "Bearer sekrit")
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("want 404 for unknown device, got %d", w.Code)
+	}
+}
+
+func TestRelayCycleDelay(t *testing.T) {
+	s := New(collector.New(nil, "", clockwork.NewFakeClock())).NewHttpServer()
+	s.controlToken = "sekrit"
+	for url, want := range map[string]int{
+		"/api/devices/FFFF/relay/cycle?delay=30h":   http.StatusBadRequest,
+		"/api/devices/FFFF/relay/cycle?delay=-1s":   http.StatusBadRequest,
+		"/api/devices/FFFF/relay/cycle?delay=bogus": http.StatusBadRequest,
+		"/api/devices/FFFF/relay/cycle?delay=30s":   http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", url, nil)
+		r.Header.Set("Authorization", "Bearer sekrit")
+		s.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s: want %d, got %d", url, want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+var (
+	streamBuffer       = flag.Int("stream-buffer", 100, "Events buffered per live stream client, beyond which they're dropped")
+	streamWriteTimeout = flag.Duration("stream-write-timeout", 10*time.Second, "Time after which a live stream client not accepting events is disconnected")
+	streamKeepalive    = flag.Duration("stream-keepalive", 30*time.Second, "Interval at which idle live streams are sent a comment to keep them open")
+)
+
+// streamEvent is the JSON form of a collector.TypedEvent.
+type streamEvent struct {
+	Time            time.Time           `json:"time"`
+	Type            collector.EventType `json:"type"`
+	Device          collector.Identity  `json:"device"`
+	Sample          *collector.Sample   `json:"sample,omitempty"`
+	Power           *float64            `json:"power,omitempty"`
+	DurationSeconds float64             `json:"duration_seconds,omitempty"`
+	Cycle           *collector.Cycle    `json:"cycle,omitempty"`
+	Alert           *collector.Alert    `json:"alert,omitempty"`
+	Error           string              `json:"error,omitempty"`
+}
+
+func newStreamEvent(e collector.TypedEvent) streamEvent {
+	se := streamEvent{Time: e.EventTime(), Device: e.EventDevice()}
+	switch e := e.(type) {
+	case collector.Sampled:
+		se.Type, se.Sample = collector.EventSample, &e.Sample
+	case collector.TransitionOn:
+		se.Type, se.Power, se.Cycle = collector.EventOn, &e.Power, e.Cycle
+		se.DurationSeconds = e.OffDuration.Seconds()
+	case collector.TransitionOff:
+		se.Type, se.Power, se.Cycle = collector.EventOff, &e.Power, e.Cycle
+		se.DurationSeconds = e.OnDuration.Seconds()
+	case collector.DeviceOnline:
+		se.Type = collector.EventOnline
+	case collector.DeviceOffline:
+		se.Type, se.Error = collector.EventOffline, e.Err
+	case collector.AlertChanged:
+		se.Type, se.Alert = collector.EventAlertResolved, &e.Alert
+		if e.Alert.Firing {
+			se.Type = collector.EventAlertFiring
+		}
+	}
+	return se
+}
+
+// streamTypes are the event types which may be streamed.
+var streamTypes = []collector.EventType{
+	collector.EventSample,
+	collector.EventOn,
+	collector.EventOff,
+	collector.EventOnline,
+	collector.EventOffline,
+	collector.EventAlertFiring,
+	collector.EventAlertResolved,
+}
+
+// streamFilter selects the events sent to a client.  Empty fields match
+// everything.
+type streamFilter struct {
+	devices []string
+	types   map[collector.EventType]bool
+}
+
+// parseStreamFilter reads ?device= and ?type=, each repeatable or
+// comma-separated.
+func parseStreamFilter(r *http.Request) (streamFilter, error) {
+	var f streamFilter
+	split := func(key string) []string {
+		var vs []string
+		for _, v := range r.URL.Query()[key] {
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					vs = append(vs, s)
+				}
+			}
+		}
+		return vs
+	}
+	f.devices = split("device")
+	for _, t := range split("type") {
+		known := false
+		for _, st := range streamTypes {
+			known = known || collector.EventType(t) == st
+		}
+		if !known {
+			return f, fmt.Errorf("unknown event type %q", t)
+		}
+		if f.types == nil {
+			f.types = map[collector.EventType]bool{}
+		}
+		f.types[collector.EventType(t)] = true
+	}
+	return f, nil
+}
+
+// match is whether e should be sent.  Devices are matched by ID, address,
+// MAC or alias (ignoring case), so a filter still matches once a device's
+// ID changes from its address to its MAC.
+func (f streamFilter) match(e streamEvent) bool {
+	if f.types != nil && !f.types[e.Type] {
+		return false
+	}
+	if len(f.devices) == 0 {
+		return true
+	}
+	id := e.Device
+	for _, d := range f.devices {
+		if d == id.DeviceID || d == id.Addr || d == id.MAC || (id.Alias != "" && strings.EqualFold(d, id.Alias)) {
+			return true
+		}
+	}
+	return false
+}
+
+// stream sends events as they happen as Server-Sent Events, optionally
+// restricted to ?device= and ?type=.
+func (s *HttpServer) stream(w http.ResponseWriter, r *http.Request) {
+	f, err := parseStreamFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// filtering as events are delivered, rather than as they're sent,
+	// leaves the buffer to the events the client wants.
+	sub := s.collector.SubscribeFunc(r.Context(), *streamBuffer, func(e collector.TypedEvent) bool {
+		return f.match(newStreamEvent(e))
+	})
+	s.serveStream(r.Context(), w, sub.C, sub.Dropped)
+}
+
+// serveStream writes the events from c to w until ctx is done, c is
+// closed or a write fails or times out.  Slow clients don't hold up the
+// collector: events arriving while c is full are dropped, and the client
+// is told how many with a "dropped" event so it may catch up through the
+// JSON API.
+func (s *HttpServer) serveStream(ctx context.Context, w http.ResponseWriter, c <-chan collector.TypedEvent, dropped func() uint64) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	write := func(format string, args ...interface{}) bool {
+		if err := rc.SetWriteDeadline(time.Now().Add(*streamWriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	if !write("retry: 5000\n\n") {
+		return
+	}
+	keepalive := time.NewTicker(*streamKeepalive)
+	defer keepalive.Stop()
+	var reported uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepalive.C:
+			if !write(": keepalive\n\n") {
+				return
+			}
+		case e, ok := <-c:
+			if !ok {
+				return
+			}
+			if n := dropped(); n > reported {
+				if !write("event: dropped\ndata: {\"dropped\":%d}\n\n", n-reported) {
+					return
+				}
+				reported = n
+			}
+			se := newStreamEvent(e)
+			b, err := json.Marshal(se)
+			if err != nil {
+				log.Printf("error encoding %s event: %v", se.Type, err)
+				continue
+			}
+			if !write("event: %s\ndata: %s\n\n", se.Type, b) {
+				return
+			}
+			keepalive.Reset(*streamKeepalive)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package exporter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+func TestStreamFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/stream?device=Freezer&type=on,off&type=offline", nil)
+	f, err := parseStreamFilter(r)
+	if err != nil {
+		t.Fatalf("error parsing filter: %v", err)
+	}
+	freezer := collector.Identity{DeviceID: "FFFF", Addr: "127.0.0.1", Alias: "freezer"}
+	fridge := collector.Identity{DeviceID: "EEEE", Addr: "127.0.0.2", Alias: "fridge"}
+	for _, tc := range []struct {
+		e    collector.TypedEvent
+		want bool
+	}{
+		{collector.Sampled{Header: collector.Header{Device: freezer}}, false},
+		{collector.TransitionOn{Header: collector.Header{Device: freezer}}, true},
+		{collector.TransitionOn{Header: collector.Header{Device: fridge}}, false},
+		{collector.DeviceOffline{Header: collector.Header{Device: freezer}}, true},
+	} {
+		if got := f.match(newStreamEvent(tc.e)); got != tc.want {
+			t.Errorf("%T %s: want match %t, got %t", tc.e, tc.e.EventDevice().Alias, tc.want, got)
+		}
+	}
+}
+
+func TestServeStream(t *testing.T) {
+	s, _ := newTestServer(t)
+	freezer := collector.Identity{DeviceID: "FFFF", Addr: "127.0.0.1", Alias: "freezer"}
+	at := time.Date(2024, 3, 12, 20, 0, 0, 0, time.UTC)
+	c := make(chan collector.TypedEvent, 10)
+	c <- collector.TransitionOn{Header: collector.Header{Time: at, Device: freezer}, Power: 90, OffDuration: 20 * time.Minute}
+	c <- collector.DeviceOffline{Header: collector.Header{Time: at, Device: freezer}, Err: "unreachable"}
+	close(c)
+	var dropped uint64
+	drops := func() uint64 { dropped += 2; return dropped }
+
+	w := httptest.NewRecorder()
+	s.serveStream(context.Background(), w, c, drops)
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("want event stream, got %s", ct)
+	}
+	type message struct {
+		event string
+		data  streamEvent
+	}
+	var got []message
+	var m message
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			m.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if m.event != "dropped" {
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &m.data); err != nil {
+					t.Fatalf("error decoding %q: %v", line, err)
+				}
+			}
+		case line == "" && m.event != "":
+			got = append(got, m)
+			m = message{}
+		}
+	}
+	// each event read reports two more dropped
+	want := []string{"dropped", "on", "dropped", "offline"}
+	if len(got) != len(want) {
+		t.Fatalf("want events %v, got %v", want, got)
+	}
+	for i, m := range got {
+		if m.event != want[i] {
+			t.Errorf("event %d: want %s, got %s", i, want[i], m.event)
+		}
+	}
+	if on := got[1].data; on.Device.DeviceID != "FFFF" || on.DurationSeconds != 1200 || on.Power == nil || *on.Power != 90 {
+		t.Errorf("want freezer on after 1200s, got %+v", on)
+	}
+	if off := got[3].data; off.Type != collector.EventOffline || off.Error != "unreachable" {
+		t.Errorf("want freezer offline, got %+v", off)
+	}
+}
+
+func TestStream(t *testing.T) {
+	s, _ := newTestServer(t)
+	if code := get(t, s, "/api/stream?type=bogus", nil); code != http.StatusBadRequest {
+		t.Errorf("want 400 for unknown type, got %d", code)
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/api/stream?type=sample", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error opening stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("want event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "retry: 5000\n" {
+		t.Errorf("want retry interval, got %q, %v", line, err)
+	}
+	cancel()
+}
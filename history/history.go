@@ -0,0 +1,419 @@
+// Package history keeps per-device samples, completed cycles and events in
+// an embedded bbolt database, with hourly rollups of samples and
+// retention-based pruning.
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"log"
+	"math"
+	"time"
+
+	"github.com/aqua/kasadutycycle/collector"
+	bolt "go.etcd.io/bbolt"
+)
+
+var sampleRetention = flag.Duration("history-sample-retention", 7*24*time.Hour, "How long raw samples are kept in the history store")
+var rollupRetention = flag.Duration("history-rollup-retention", 365*24*time.Hour, "How long hourly rollups are kept in the history store")
+var cycleRetention = flag.Duration("history-cycle-retention", 365*24*time.Hour, "How long completed cycles and events are kept in the history store")
+
+// RollupInterval is the resolution to which samples are downsampled.
+const RollupInterval = time.Hour
+
+var (
+	samplesBucket = []byte("samples")
+	rollupsBucket = []byte("rollups")
+	cyclesBucket  = []byte("cycles")
+	eventsBucket  = []byte("events")
+)
+
+// Store is a history database.  Each top-level bucket holds a bucket per
+// device, keyed by timestamp.
+type Store struct {
+	db  *bolt.DB
+	now func() time.Time
+}
+
+// Open opens (creating if need be) the store at path.
+func Open(path string) (*Store, error) {
+	return open(path, &bolt.Options{Timeout: time.Second})
+}
+
+// OpenReadOnly opens an existing store for reading, as from the CLI.
+func OpenReadOnly(path string) (*Store, error) {
+	return open(path, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+}
+
+func open(path string, opts *bolt.Options) (*Store, error) {
+	db, err := bolt.Open(path, 0600, opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{db: db, now: time.Now}
+	if opts.ReadOnly {
+		return s, nil
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{samplesBucket, rollupsBucket, cyclesBucket, eventsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Sample is a stored sample.
+type Sample struct {
+	Time time.Time `json:"time"`
+	collector.Sample
+}
+
+// Rollup summarizes the samples of a device over RollupInterval.
+type Rollup struct {
+	Start     time.Time `json:"start"`
+	Samples   int       `json:"samples"`
+	OnSamples int       `json:"on_samples"`
+	MinPower  float64   `json:"min_power"`
+	MaxPower  float64   `json:"max_power"`
+	SumPower  float64   `json:"sum_power"`
+	// first and last energy counter readings, for energy used
+	FirstKwH float64 `json:"first_kwh"`
+	LastKwH  float64 `json:"last_kwh"`
+}
+
+func (r *Rollup) MeanPower() float64 {
+	if r.Samples == 0 {
+		return 0
+	}
+	return r.SumPower / float64(r.Samples)
+}
+
+// Cycle is a stored completed cycle.
+type Cycle struct {
+	Device string `json:"device"`
+	collector.Cycle
+}
+
+// key orders entries by time; seq disambiguates entries with the same
+// timestamp.
+func key(t time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+func keyTime(k []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))
+}
+
+func deviceBucket(tx *bolt.Tx, top []byte, device string) (*bolt.Bucket, error) {
+	return tx.Bucket(top).CreateBucketIfNotExists([]byte(device))
+}
+
+func put(b *bolt.Bucket, t time.Time, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	return b.Put(key(t, seq), buf)
+}
+
+// HandleEvent implements collector.EventSink.
+func (s *Store) HandleEvent(e collector.Event) {
+	var err error
+	switch {
+	case e.Type == collector.EventSample && e.Sample != nil:
+		err = s.AddSample(e.Device, e.Time, *e.Sample)
+	case e.Cycle != nil:
+		if err = s.AddCycle(e.Device, *e.Cycle); err == nil {
+			err = s.AddEvent(e)
+		}
+	default:
+		err = s.AddEvent(e)
+	}
+	if err != nil {
+		log.Printf("error storing %s event of %s: %v", e.Type, e.Device, err)
+	}
+}
+
+// AddSample stores a sample and folds it into its hourly rollup.
+func (s *Store) AddSample(device string, t time.Time, smp collector.Sample) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := deviceBucket(tx, samplesBucket, device)
+		if err != nil {
+			return err
+		}
+		if err := put(b, t, Sample{Time: t, Sample: smp}); err != nil {
+			return err
+		}
+
+		rb, err := deviceBucket(tx, rollupsBucket, device)
+		if err != nil {
+			return err
+		}
+		start := t.Truncate(RollupInterval)
+		k := key(start, 0)
+		r := Rollup{Start: start, MinPower: math.Inf(1), FirstKwH: smp.TotalKwH}
+		if v := rb.Get(k); v != nil {
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+		}
+		r.Samples++
+		if smp.On {
+			r.OnSamples++
+		}
+		r.MinPower = math.Min(r.MinPower, smp.Power)
+		r.MaxPower = math.Max(r.MaxPower, smp.Power)
+		r.SumPower += smp.Power
+		r.LastKwH = smp.TotalKwH
+		buf, err := json.Marshal(&r)
+		if err != nil {
+			return err
+		}
+		return rb.Put(k, buf)
+	})
+}
+
+func (s *Store) AddCycle(device string, c collector.Cycle) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := deviceBucket(tx, cyclesBucket, device)
+		if err != nil {
+			return err
+		}
+		return put(b, c.Start, Cycle{Device: device, Cycle: c})
+	})
+}
+
+func (s *Store) AddEvent(e collector.Event) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := deviceBucket(tx, eventsBucket, e.Device)
+		if err != nil {
+			return err
+		}
+		return put(b, e.Time, e)
+	})
+}
+
+// scan calls fn with each value of device's bucket under top whose
+// timestamp is in [from, to), newest first if reverse, until fn returns
+// false.  Zero times mean no bound.
+func (s *Store) scan(top []byte, device string, from, to time.Time, reverse bool, fn func(v []byte) (bool, error)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		tb := tx.Bucket(top)
+		if tb == nil {
+			return nil
+		}
+		b := tb.Bucket([]byte(device))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		inRange := func(k []byte) bool {
+			t := keyTime(k)
+			return !t.Before(from) && (to.IsZero() || t.Before(to))
+		}
+		var k, v []byte
+		if reverse {
+			if to.IsZero() {
+				k, v = c.Last()
+			} else if k, v = c.Seek(key(to, 0)); k == nil {
+				k, v = c.Last()
+			}
+			for ; k != nil && !keyTime(k).Before(from); k, v = c.Prev() {
+				if !inRange(k) {
+					continue
+				}
+				if more, err := fn(v); err != nil || !more {
+					return err
+				}
+			}
+			return nil
+		}
+		if from.IsZero() {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(key(from, 0))
+		}
+		for ; k != nil && inRange(k); k, v = c.Next() {
+			if more, err := fn(v); err != nil || !more {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Samples returns the samples of device in [from, to), oldest first.
+func (s *Store) Samples(device string, from, to time.Time) ([]Sample, error) {
+	var out []Sample
+	err := s.scan(samplesBucket, device, from, to, false, func(v []byte) (bool, error) {
+		var smp Sample
+		if err := json.Unmarshal(v, &smp); err != nil {
+			return false, err
+		}
+		out = append(out, smp)
+		return true, nil
+	})
+	return out, err
+}
+
+// Rollups returns the hourly rollups of device starting in [from, to),
+// oldest first.
+func (s *Store) Rollups(device string, from, to time.Time) ([]Rollup, error) {
+	var out []Rollup
+	err := s.scan(rollupsBucket, device, from, to, false, func(v []byte) (bool, error) {
+		var r Rollup
+		if err := json.Unmarshal(v, &r); err != nil {
+			return false, err
+		}
+		out = append(out, r)
+		return true, nil
+	})
+	return out, err
+}
+
+// CycleFilter selects cycles.  Zero values select everything.
+type CycleFilter struct {
+	From, To time.Time
+	On, Off  bool // phases to include; neither means both
+	Limit    int
+}
+
+// Cycles returns device's cycles starting in the filter's range, newest
+// first.
+func (s *Store) Cycles(device string, f CycleFilter) ([]Cycle, error) {
+	var out []Cycle
+	err := s.scan(cyclesBucket, device, f.From, f.To, true, func(v []byte) (bool, error) {
+		var c Cycle
+		if err := json.Unmarshal(v, &c); err != nil {
+			return false, err
+		}
+		if f.On == f.Off || c.On == f.On {
+			out = append(out, c)
+		}
+		return f.Limit <= 0 || len(out) < f.Limit, nil
+	})
+	return out, err
+}
+
+// CycleStats derives the energy used (from the energy counter) and peak
+// power during c from the samples stored for device, if any remain.
+func (s *Store) CycleStats(device string, c Cycle) (energyKwH, peakWatts float64, ok bool) {
+	samples, err := s.Samples(device, c.Start, c.End.Add(time.Nanosecond))
+	if err != nil || len(samples) == 0 {
+		return 0, 0, false
+	}
+	for _, smp := range samples {
+		peakWatts = math.Max(peakWatts, smp.Power)
+	}
+	return samples[len(samples)-1].TotalKwH - samples[0].TotalKwH, peakWatts, true
+}
+
+// Events returns up to limit (if positive) of device's events in
+// [from, to), newest first.
+func (s *Store) Events(device string, from, to time.Time, limit int) ([]collector.Event, error) {
+	var out []collector.Event
+	err := s.scan(eventsBucket, device, from, to, true, func(v []byte) (bool, error) {
+		var e collector.Event
+		if err := json.Unmarshal(v, &e); err != nil {
+			return false, err
+		}
+		out = append(out, e)
+		return limit <= 0 || len(out) < limit, nil
+	})
+	return out, err
+}
+
+// Devices lists the devices with any stored history.
+func (s *Store) Devices() ([]string, error) {
+	seen := map[string]bool{}
+	var out []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, top := range [][]byte{samplesBucket, cyclesBucket, eventsBucket} {
+			tb := tx.Bucket(top)
+			if tb == nil {
+				continue
+			}
+			err := tb.ForEach(func(k, v []byte) error {
+				if v == nil && !seen[string(k)] {
+					seen[string(k)] = true
+					out = append(out, string(k))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+// Prune deletes entries older than their retention period.
+func (s *Store) Prune() error {
+	now := s.now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, p := range []struct {
+			top    []byte
+			cutoff time.Time
+		}{
+			{samplesBucket, now.Add(-*sampleRetention)},
+			{rollupsBucket, now.Add(-*rollupRetention)},
+			{cyclesBucket, now.Add(-*cycleRetention)},
+			{eventsBucket, now.Add(-*cycleRetention)},
+		} {
+			tb := tx.Bucket(p.top)
+			var devices [][]byte
+			tb.ForEach(func(k, v []byte) error {
+				if v == nil {
+					devices = append(devices, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			for _, device := range devices {
+				c := tb.Bucket(device).Cursor()
+				for k, _ := c.First(); k != nil && keyTime(k).Before(p.cutoff); k, _ = c.First() {
+					if err := c.Delete(); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Run prunes the store every interval until shutdown is closed.
+func (s *Store) Run(interval time.Duration, shutdown <-chan bool) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := s.Prune(); err != nil {
+			log.Printf("error pruning history: %v", err)
+		}
+		select {
+		case <-shutdown:
+			return
+		case <-t.C:
+		}
+	}
+}
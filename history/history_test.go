@@ -0,0 +1,128 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+func openTestStore(t *testing.T) *Store {
+	s, err := Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+var start = time.Date(2024, 3, 12, 20, 0, 0, 0, time.UTC)
+
+func TestSamplesAndRollups(t *testing.T) {
+	s := openTestStore(t)
+	for i := 0; i < 90; i++ {
+		on := i%3 == 0
+		power := 0.5
+		if on {
+			power = 90
+		}
+		s.HandleEvent(collector.Event{
+			Time:   start.Add(time.Duration(i) * time.Minute),
+			Device: "FFFF",
+			Type:   collector.EventSample,
+			Sample: &collector.Sample{Power: power, On: on, TotalKwH: 1 + float64(i)/1000},
+		})
+	}
+	samples, err := s.Samples("FFFF", start.Add(10*time.Minute), start.Add(20*time.Minute))
+	if err != nil {
+		t.Fatalf("error reading samples: %v", err)
+	}
+	if len(samples) != 10 || !samples[0].Time.Equal(start.Add(10*time.Minute)) {
+		t.Errorf("want 10 samples from 20:10, got %d: %v", len(samples), samples)
+	}
+
+	rollups, err := s.Rollups("FFFF", start, time.Time{})
+	if err != nil {
+		t.Fatalf("error reading rollups: %v", err)
+	}
+	if len(rollups) != 2 {
+		t.Fatalf("want 2 hourly rollups, got %v", rollups)
+	}
+	r := rollups[0]
+	if r.Samples != 60 || r.OnSamples != 20 || r.MinPower != 0.5 || r.MaxPower != 90 {
+		t.Errorf("unexpected first rollup %+v", r)
+	}
+	if mean := r.MeanPower(); mean < 30.3 || mean > 30.4 {
+		t.Errorf("want mean power of 30.33w, got %f", mean)
+	}
+	if r.FirstKwH != 1 || r.LastKwH != 1.059 {
+		t.Errorf("want energy counter range 1-1.059, got %f-%f", r.FirstKwH, r.LastKwH)
+	}
+}
+
+func TestCyclesAndEvents(t *testing.T) {
+	s := openTestStore(t)
+	for i := 0; i < 10; i++ {
+		end := start.Add(time.Duration(i+1) * 10 * time.Minute)
+		typ := collector.EventOn
+		if i%2 == 0 {
+			typ = collector.EventOff
+		}
+		s.HandleEvent(collector.Event{
+			Time:   end,
+			Device: "FFFF",
+			Type:   typ,
+			Cycle: &collector.Cycle{
+				On:       typ == collector.EventOff,
+				Start:    end.Add(-10 * time.Minute),
+				End:      end,
+				Duration: 10 * time.Minute,
+			},
+		})
+	}
+	s.HandleEvent(collector.Event{Time: start.Add(2 * time.Hour), Device: "FFFF", Type: collector.EventRelayOff})
+
+	cycles, err := s.Cycles("FFFF", CycleFilter{On: true, Limit: 3})
+	if err != nil {
+		t.Fatalf("error reading cycles: %v", err)
+	}
+	if len(cycles) != 3 || !cycles[0].On || !cycles[0].Start.Equal(start.Add(80*time.Minute)) {
+		t.Errorf("want 3 most recent on cycles, got %v", cycles)
+	}
+	all, _ := s.Cycles("FFFF", CycleFilter{From: start.Add(30 * time.Minute), To: start.Add(60 * time.Minute)})
+	if len(all) != 3 {
+		t.Errorf("want 3 cycles starting 20:30-21:00, got %v", all)
+	}
+
+	events, err := s.Events("FFFF", time.Time{}, time.Time{}, 2)
+	if err != nil {
+		t.Fatalf("error reading events: %v", err)
+	}
+	if len(events) != 2 || events[0].Type != collector.EventRelayOff {
+		t.Errorf("want most recent 2 events, got %v", events)
+	}
+	devices, _ := s.Devices()
+	if len(devices) != 1 || devices[0] != "FFFF" {
+		t.Errorf("want one device, got %v", devices)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	s := openTestStore(t)
+	for i := 0; i < 10; i++ {
+		s.AddSample("FFFF", start.Add(time.Duration(i)*24*time.Hour), collector.Sample{Power: 1})
+	}
+	s.now = func() time.Time { return start.Add(10 * 24 * time.Hour) }
+	if err := s.Prune(); err != nil {
+		t.Fatalf("error pruning: %v", err)
+	}
+	samples, _ := s.Samples("FFFF", time.Time{}, time.Time{})
+	if len(samples) != 7 {
+		t.Errorf("want 7 days of samples retained, got %d", len(samples))
+	}
+	rollups, _ := s.Rollups("FFFF", time.Time{}, time.Time{})
+	if len(rollups) != 10 {
+		t.Errorf("want all rollups retained, got %d", len(rollups))
+	}
+}
@@ -0,0 +1,255 @@
+// Package hook runs configured commands when devices transition, alerts
+// fire, and so on, passing the event in environment variables and as JSON
+// on stdin.
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+var concurrency = flag.Int("hook-concurrency", 4, "Maximum number of hook commands running at once")
+
+const (
+	queueSize = 100
+	maxOutput = 1024 // bytes of a failed command's output logged
+)
+
+// Hook is the configuration of a single hook command.
+type Hook struct {
+	Name    string   `json:"name,omitempty"`
+	Command []string `json:"command"` // program and arguments
+
+	// Events and Devices (ID, address or alias) restrict the events run
+	// for; by default every event but samples.
+	Events  []collector.EventType `json:"events,omitempty"`
+	Devices []string              `json:"devices,omitempty"`
+
+	Timeout collector.Duration `json:"timeout,omitempty"` // default 30s
+}
+
+// Load reads a JSON list of Hooks from path.
+func Load(path string) ([]Hook, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []Hook
+	if err := json.Unmarshal(b, &hooks); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return hooks, nil
+}
+
+type job struct {
+	hook  *Hook
+	event collector.Event
+}
+
+// Runner is a collector.EventSink running hook commands, at most
+// -hook-concurrency at a time.  It's also a prometheus.Collector of its
+// run and failure counts.
+type Runner struct {
+	hooks []*Hook
+	queue chan job
+	wg    sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool // queue
+
+	runs, failures, dropped *prometheus.CounterVec
+}
+
+// New starts a Runner for hooks.
+func New(hooks []Hook) (*Runner, error) {
+	r := &Runner{
+		queue: make(chan job, queueSize),
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hook_runs_total",
+			Help: "Hook commands run.",
+		}, []string{"hook"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hook_failures_total",
+			Help: "Hook commands which failed to start, exited unsuccessfully, or timed out.",
+		}, []string{"hook", "reason"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hook_dropped_total",
+			Help: "Hook commands not run because too many were waiting to.",
+		}, []string{"hook"}),
+	}
+	for i := range hooks {
+		h := hooks[i]
+		if len(h.Command) == 0 {
+			return nil, fmt.Errorf("hook %d: no command", i)
+		}
+		if h.Name == "" {
+			h.Name = h.Command[0]
+		}
+		if h.Timeout == 0 {
+			h.Timeout = collector.Duration(30 * time.Second)
+		}
+		r.hooks = append(r.hooks, &h)
+	}
+	for i := 0; i < max(*concurrency, 1); i++ {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			for j := range r.queue {
+				r.run(j.hook, j.event)
+			}
+		}()
+	}
+	return r, nil
+}
+
+// HandleEvent implements collector.EventSink, queueing the hooks wanting
+// the event.  Should too many be waiting, the event's hooks are dropped, as
+// are events arriving after Close.
+func (r *Runner) HandleEvent(e collector.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	for _, h := range r.hooks {
+		if !h.wants(e) {
+			continue
+		}
+		select {
+		case r.queue <- job{h, e}:
+		default:
+			r.dropped.WithLabelValues(h.Name).Inc()
+			log.Printf("hook %s: too many waiting, dropping %s event for %s", h.Name, e.Type, e.Device)
+		}
+	}
+}
+
+// Close waits for queued hooks to run.
+func (r *Runner) Close() {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+func (h *Hook) wants(e collector.Event) bool {
+	if len(h.Events) == 0 {
+		if e.Type == collector.EventSample {
+			return false
+		}
+	} else {
+		found := false
+		for _, t := range h.Events {
+			found = found || t == e.Type
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(h.Devices) == 0 {
+		return true
+	}
+	for _, d := range h.Devices {
+		if d == e.Device || d == e.Addr || (e.Alias != "" && strings.EqualFold(d, e.Alias)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Env returns the environment variables describing e.
+func Env(e collector.Event) []string {
+	env := []string{
+		"KASA_EVENT=" + string(e.Type),
+		"KASA_TIME=" + e.Time.Format(time.RFC3339),
+		"KASA_DEVICE=" + e.Device,
+		"KASA_ALIAS=" + e.Alias,
+		"KASA_ADDR=" + e.Addr,
+		"KASA_DETAIL=" + e.Detail,
+	}
+	if e.Duration != 0 {
+		env = append(env, "KASA_DURATION_SECONDS="+strconv.FormatFloat(e.Duration.Seconds(), 'f', -1, 64))
+	}
+	if e.Power != 0 {
+		env = append(env, "KASA_POWER="+strconv.FormatFloat(e.Power, 'f', -1, 64))
+	}
+	if e.Cycle != nil && e.Cycle.EnergyKwH != 0 {
+		env = append(env, "KASA_ENERGY_KWH="+strconv.FormatFloat(e.Cycle.EnergyKwH, 'f', -1, 64))
+	}
+	if a := e.Alert; a != nil {
+		env = append(env,
+			"KASA_ALERT="+a.Name,
+			"KASA_ALERT_SEVERITY="+a.Severity,
+			"KASA_ALERT_FIRING="+strconv.FormatBool(a.Firing))
+	}
+	return env
+}
+
+// run runs h for e, noting the outcome.
+func (r *Runner) run(h *Hook, e collector.Event) {
+	r.runs.WithLabelValues(h.Name).Inc()
+	stdin, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("hook %s: error encoding event: %v", h.Name, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(h.Timeout))
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(), Env(e)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	// don't wait long on any children left holding the output open
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	var reason string
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return
+	case ctx.Err() == context.DeadlineExceeded:
+		reason = "timeout"
+	case errors.As(err, &exit):
+		reason = "exit"
+	default:
+		reason = "start"
+	}
+	r.failures.WithLabelValues(h.Name, reason).Inc()
+	output := out.String()
+	if len(output) > maxOutput {
+		output = output[:maxOutput] + "…"
+	}
+	log.Printf("hook %s: %s event for %s: %v (%s): %s", h.Name, e.Type, e.Device, err, reason, output)
+}
+
+func (r *Runner) Describe(ch chan<- *prometheus.Desc) {
+	r.runs.Describe(ch)
+	r.failures.Describe(ch)
+	r.dropped.Describe(ch)
+}
+
+func (r *Runner) Collect(ch chan<- prometheus.Metric) {
+	r.runs.Collect(ch)
+	r.failures.Collect(ch)
+	r.dropped.Collect(ch)
+}
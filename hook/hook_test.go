@@ -0,0 +1,89 @@
+package hook
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+var off = collector.Event{
+	Time:     time.Date(2024, 3, 12, 20, 0, 0, 0, time.UTC),
+	Device:   "FFFF",
+	Alias:    "freezer",
+	Addr:     "127.0.0.1",
+	Type:     collector.EventOff,
+	Duration: 10 * time.Minute,
+	Power:    0.5,
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	r, err := New([]Hook{{
+		Name:    "record",
+		Command: []string{"sh", "-c", `env | grep ^KASA_ | sort > "$0/env"; cat > "$0/stdin"`, dir},
+		Events:  []collector.EventType{collector.EventOff},
+		Devices: []string{"Freezer"},
+	}})
+	if err != nil {
+		t.Fatalf("error creating runner: %v", err)
+	}
+	on := off
+	on.Type = collector.EventOn
+	r.HandleEvent(on)
+	r.HandleEvent(off)
+	r.Close()
+	// events arriving after Close, as from a relay change while shutting
+	// down, are dropped
+	r.HandleEvent(off)
+	r.Close()
+
+	if n := testutil.ToFloat64(r.runs.WithLabelValues("record")); n != 1 {
+		t.Errorf("want 1 run, got %v", n)
+	}
+	env, err := os.ReadFile(filepath.Join(dir, "env"))
+	if err != nil {
+		t.Fatalf("error reading env: %v", err)
+	}
+	for _, want := range []string{"KASA_EVENT=off", "KASA_DEVICE=FFFF", "KASA_ALIAS=freezer", "KASA_DURATION_SECONDS=600", "KASA_POWER=0.5"} {
+		if !strings.Contains(string(env), want+"\n") {
+			t.Errorf("want %s in environment:\n%s", want, env)
+		}
+	}
+	stdin, err := os.ReadFile(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatalf("error reading stdin: %v", err)
+	}
+	var e collector.Event
+	if err := json.Unmarshal(stdin, &e); err != nil || e.Type != collector.EventOff || e.Device != "FFFF" {
+		t.Errorf("want off event on stdin, got %s (%v)", stdin, err)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	r, err := New([]Hook{
+		{Name: "exit", Command: []string{"sh", "-c", "exit 3"}},
+		{Name: "slow", Command: []string{"sleep", "10"}, Timeout: collector.Duration(50 * time.Millisecond)},
+		{Name: "missing", Command: []string{filepath.Join(t.TempDir(), "missing")}},
+	})
+	if err != nil {
+		t.Fatalf("error creating runner: %v", err)
+	}
+	start := time.Now()
+	r.HandleEvent(off)
+	r.Close()
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("want slow hook killed, took %s", d)
+	}
+	for _, f := range []struct{ hook, reason string }{{"exit", "exit"}, {"slow", "timeout"}, {"missing", "start"}} {
+		if n := testutil.ToFloat64(r.failures.WithLabelValues(f.hook, f.reason)); n != 1 {
+			t.Errorf("want 1 %s failure of %s, got %v", f.reason, f.hook, n)
+		}
+	}
+}
@@ -1,13 +1,30 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/aqua/kasadutycycle/alerting"
+	"github.com/aqua/kasadutycycle/alertmanager"
 	"github.com/aqua/kasadutycycle/collector"
+	"github.com/aqua/kasadutycycle/discovery"
+	"github.com/aqua/kasadutycycle/email"
+	"github.com/aqua/kasadutycycle/eventlog"
 	"github.com/aqua/kasadutycycle/exporter"
+	"github.com/aqua/kasadutycycle/history"
+	"github.com/aqua/kasadutycycle/hook"
+	"github.com/aqua/kasadutycycle/mqtt"
+	"github.com/aqua/kasadutycycle/webhook"
 	"github.com/jonboulle/clockwork"
 )
 
@@ -24,21 +41,203 @@ func (l *targetList) Set(v string) error {
 var (
 	targetsFlag       targetList
 	httpListenAddress = flag.String("http-listen-address", "localhost:8080", "Address for Prometheus HTTP server ([address]:port)")
+	externalURL       = flag.String("external-url", "", "URL at which the exporter is reachable, linked from alerts")
 	checkpointFile    = flag.String("checkpoint-file", "", "Path to save checkpoints (preserves continuity across restarts)")
+	eventLogFile      = flag.String("event-log", "", "Path of an append-only JSON lines log of transitions and other events")
+	eventLogMaxBytes  = flag.Int64("event-log-max-bytes", 10<<20, "Size at which the event log is rotated")
+	eventLogKeep      = flag.Int("event-log-keep", 5, "Number of rotated event logs to keep")
+	alertConfig       = flag.String("alert-config", "", "JSON file of alert grouping, repeat and routing settings")
+	silencesFile      = flag.String("silences-file", "", "Path at which to persist alert silences")
+	alertmanagerURLs  = flag.String("alertmanager-urls", "", "Comma-separated Prometheus Alertmanager URLs to push alerts to")
+	hookConfig        = flag.String("hook-config", "", "JSON file listing commands to run on transitions, alerts and other events")
+	historyDB         = flag.String("history-db", "", "Path of the embedded history store of samples, cycles and events")
+	mqttBroker        = flag.String("mqtt-broker", "", "MQTT broker to publish device state and events to (e.g. tcp://localhost:1883, ssl://host:8883)")
+	smtpServer        = flag.String("smtp-server", "", "SMTP server (host:port) through which to email alerts and digests")
+	webhookConfig     = flag.String("webhook-config", "", "JSON file listing webhooks to notify of transitions, alerts and other events")
 )
 
 func init() {
 	flag.Var(&targetsFlag, "targets", "Target(s) to monitor")
 }
 
+// discover lists the Kasa devices answering on the local network.
+func discover() {
+	devices, err := discovery.Discover()
+	if err != nil {
+		log.Fatalf("error running discovery: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDR\tMODEL\tALIAS\tMAC\tEMETER")
+	for _, d := range devices {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\n",
+			d.Addr, d.SysInfo.Model, d.SysInfo.Alias, d.SysInfo.MAC, d.EmeterSupported())
+	}
+	w.Flush()
+}
+
+// showHistory prints the stored history of a device, one JSON object per
+// line, from a history store not in use by a running exporter.
+func showHistory(args []string) {
+	if len(args) != 2 {
+		log.Fatalf("usage: kasadutycycle -history-db=<path> history <device> samples|rollups|cycles|events")
+	}
+	h, err := history.OpenReadOnly(*historyDB)
+	if err != nil {
+		log.Fatalf("error opening history store %s (is the exporter running? try the HTTP API): %v", *historyDB, err)
+	}
+	defer h.Close()
+	device := args[0]
+	switch args[1] {
+	case "samples":
+		err = printLines(h.Samples(device, time.Time{}, time.Time{}))
+	case "rollups":
+		err = printLines(h.Rollups(device, time.Time{}, time.Time{}))
+	case "cycles":
+		err = printLines(h.Cycles(device, history.CycleFilter{}))
+	case "events":
+		err = printLines(h.Events(device, time.Time{}, time.Time{}, 0))
+	default:
+		log.Fatalf("unknown history kind %q", args[1])
+	}
+	if err != nil {
+		log.Fatalf("error reading history: %v", err)
+	}
+}
+
+// printLines writes items to stdout as JSON lines.
+func printLines[T any](items []T, err error) error {
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, v := range items {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func main() {
 	flag.Parse()
+	switch flag.Arg(0) {
+	case "discover":
+		discover()
+		return
+	case "history":
+		showHistory(flag.Args()[1:])
+		return
+	}
 	c := collector.New(targetsFlag, *checkpointFile, clockwork.NewRealClock())
-	e := exporter.New(c)
+	// notifiers are closed, in order, once the collector stops, so that
+	// events already queued are still delivered.
+	var notifiers []interface{ Close() }
+	var l *eventlog.Log
+	if *eventLogFile != "" {
+		var err error
+		if l, err = eventlog.Open(*eventLogFile, *eventLogMaxBytes, *eventLogKeep); err != nil {
+			log.Fatalf("error opening event log: %v", err)
+		}
+		c.AddSink(l)
+	}
+	var alertCfg alerting.Config
+	if *alertConfig != "" {
+		var err error
+		if alertCfg, err = alerting.LoadConfig(*alertConfig); err != nil {
+			log.Fatalf("error loading alert config: %v", err)
+		}
+	}
+	am, err := alerting.New(alertCfg, *silencesFile, clockwork.NewRealClock())
+	if err != nil {
+		log.Fatalf("error configuring alerting: %v", err)
+	}
+	c.AddSink(am)
+	if *webhookConfig != "" {
+		hooks, err := webhook.Load(*webhookConfig)
+		if err != nil {
+			log.Fatalf("error loading webhooks: %v", err)
+		}
+		n, err := webhook.New(c, hooks)
+		if err != nil {
+			log.Fatalf("error configuring webhooks: %v", err)
+		}
+		c.AddSink(am.Receiver("webhook", n))
+		notifiers = append(notifiers, n)
+	}
+	if *mqttBroker != "" {
+		p, err := mqtt.New(c, *mqttBroker)
+		if err != nil {
+			log.Fatalf("error configuring MQTT: %v", err)
+		}
+		c.AddSink(am.Receiver("mqtt", p))
+		notifiers = append(notifiers, p)
+	}
 	s := make(chan bool)
-	// shutdown on s
-	go c.Run(s)
+	if *smtpServer != "" {
+		n, err := email.New(c, *smtpServer, clockwork.NewRealClock())
+		if err != nil {
+			log.Fatalf("error configuring email: %v", err)
+		}
+		c.AddSink(am.Receiver("email", n))
+		notifiers = append(notifiers, n)
+		go n.Run(s)
+	}
+	go am.Run(5*time.Second, s)
+	if *alertmanagerURLs != "" {
+		var generatorURL string
+		if *externalURL != "" {
+			generatorURL = strings.TrimSuffix(*externalURL, "/") + "/api/alerts"
+		}
+		p := alertmanager.New(c, strings.Split(*alertmanagerURLs, ","), generatorURL, clockwork.NewRealClock())
+		c.AddSink(p)
+		go p.Run(s)
+		notifiers = append(notifiers, p)
+	}
+	e := exporter.New(c)
+	e.SetAlerting(am)
+	if *hookConfig != "" {
+		hooks, err := hook.Load(*hookConfig)
+		if err != nil {
+			log.Fatalf("error loading hooks: %v", err)
+		}
+		r, err := hook.New(hooks)
+		if err != nil {
+			log.Fatalf("error configuring hooks: %v", err)
+		}
+		c.AddSink(am.Receiver("hook", r))
+		e.Register(r)
+		notifiers = append(notifiers, r)
+	}
+	var h *history.Store
+	if *historyDB != "" {
+		var err error
+		if h, err = history.Open(*historyDB); err != nil {
+			log.Fatalf("error opening history store: %v", err)
+		}
+		c.AddSink(h)
+		e.SetHistory(h)
+		go h.Run(time.Hour, s)
+	}
 	srv := e.NewHttpServer()
 	log.Printf("will listen on %s", *httpListenAddress)
-	log.Fatal(http.ListenAndServe(*httpListenAddress, srv))
+	go func() {
+		log.Fatal(http.ListenAndServe(*httpListenAddress, srv))
+	}()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	c.Run(ctx)
+	close(s)
+	for _, n := range notifiers {
+		n.Close()
+	}
+	if h != nil {
+		if err := h.Close(); err != nil {
+			log.Printf("error closing history store: %v", err)
+		}
+	}
+	if l != nil {
+		if err := l.Close(); err != nil {
+			log.Printf("error closing event log: %v", err)
+		}
+	}
 }
@@ -0,0 +1,163 @@
+package mqtt
+
+import (
+	"flag"
+	"log"
+	"regexp"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+var (
+	haDiscovery       = flag.Bool("mqtt-ha-discovery", false, "Announce devices to Home Assistant by MQTT discovery")
+	haDiscoveryPrefix = flag.String("mqtt-ha-discovery-prefix", "homeassistant", "Home Assistant's MQTT discovery prefix")
+)
+
+// haDevice groups a plug's entities in Home Assistant.
+type haDevice struct {
+	Identifiers  []string    `json:"identifiers"`
+	Connections  [][2]string `json:"connections,omitempty"`
+	Name         string      `json:"name"`
+	Manufacturer string      `json:"manufacturer"`
+	Model        string      `json:"model,omitempty"`
+	SwVersion    string      `json:"sw_version,omitempty"`
+	HwVersion    string      `json:"hw_version,omitempty"`
+}
+
+// haConfig is a Home Assistant MQTT discovery config for one entity.
+type haConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	ObjectID          string   `json:"object_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	EntityCategory    string   `json:"entity_category,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+// haEntity describes one of the entities announced for each device.
+type haEntity struct {
+	component, object, name string
+	template                string
+	deviceClass, stateClass string
+	unit                    string
+	metering                bool // only for plugs with energy meters
+}
+
+var haEntities = []haEntity{
+	{component: "binary_sensor", object: "running", name: "Running",
+		template: "{{ 'ON' if value_json.on else 'OFF' }}", deviceClass: "running"},
+	{component: "sensor", object: "power", name: "Power",
+		template: "{{ value_json.power }}", deviceClass: "power", stateClass: "measurement", unit: "W", metering: true},
+	{component: "sensor", object: "voltage", name: "Voltage",
+		template: "{{ value_json.voltage }}", deviceClass: "voltage", stateClass: "measurement", unit: "V", metering: true},
+	{component: "sensor", object: "current", name: "Current",
+		template: "{{ value_json.current }}", deviceClass: "current", stateClass: "measurement", unit: "A", metering: true},
+	{component: "sensor", object: "energy", name: "Energy",
+		template: "{{ value_json.total_kwh }}", deviceClass: "energy", stateClass: "total_increasing", unit: "kWh", metering: true},
+	{component: "sensor", object: "cycle_count", name: "Cycle count",
+		template: "{{ value_json.cycle_count }}", stateClass: "total_increasing"},
+	{component: "sensor", object: "last_on_duration", name: "Last on duration",
+		template: "{{ value_json.last_on_duration_seconds }}", deviceClass: "duration", stateClass: "measurement", unit: "s"},
+	{component: "sensor", object: "last_off_duration", name: "Last off duration",
+		template: "{{ value_json.last_off_duration_seconds }}", deviceClass: "duration", stateClass: "measurement", unit: "s"},
+}
+
+var haUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// haNodeID is a device ID made safe for discovery topics and unique IDs.
+func haNodeID(device string) string {
+	return "kasadutycycle_" + haUnsafe.ReplaceAllString(device, "_")
+}
+
+// HADiscoveryTopic returns the discovery config topic of a device's entity.
+func HADiscoveryTopic(component, device, object string) string {
+	return *haDiscoveryPrefix + "/" + component + "/" + haNodeID(device) + "/" + object + "/config"
+}
+
+// haAnnouncement is what was last announced for a device, so that it's
+// announced again only if it changes.
+type haAnnouncement struct {
+	identity collector.Identity
+	metering bool
+}
+
+// announce publishes discovery configs for a device's entities, unless
+// they're unchanged since last announced.
+func (p *Publisher) announce(s State) {
+	metering := s.Power != nil
+	a := haAnnouncement{s.Identity, metering}
+	p.mu.Lock()
+	if p.announced[s.DeviceID] == a {
+		p.mu.Unlock()
+		return
+	}
+	p.announced[s.DeviceID] = a
+	p.mu.Unlock()
+
+	name := s.Alias
+	if name == "" {
+		name = s.DeviceID
+	}
+	dev := haDevice{
+		Identifiers:  []string{haNodeID(s.DeviceID)},
+		Name:         name,
+		Manufacturer: "TP-Link",
+		Model:        s.Model,
+		SwVersion:    s.SoftwareVersion,
+		HwVersion:    s.HardwareVersion,
+	}
+	if s.MAC != "" {
+		dev.Connections = [][2]string{{"mac", s.MAC}}
+	}
+	for _, e := range haEntities {
+		topic := HADiscoveryTopic(e.component, s.DeviceID, e.object)
+		if e.metering && !metering {
+			// retract it, should the plug have been replaced
+			p.queueRaw(topic, nil, true)
+			continue
+		}
+		id := haNodeID(s.DeviceID) + "_" + e.object
+		p.publish(topic, haConfig{
+			Name:              e.name,
+			UniqueID:          id,
+			ObjectID:          id,
+			StateTopic:        Topic(s.DeviceID, "state"),
+			ValueTemplate:     e.template,
+			AvailabilityTopic: StatusTopic(),
+			DeviceClass:       e.deviceClass,
+			StateClass:        e.stateClass,
+			UnitOfMeasurement: e.unit,
+			Device:            dev,
+		}, true)
+	}
+}
+
+// haStatus re-announces every device when Home Assistant comes online,
+// as it may have forgotten them.
+func (p *Publisher) haStatus(_ paho.Client, msg paho.Message) {
+	if string(msg.Payload()) != online {
+		return
+	}
+	log.Printf("Home Assistant online; re-announcing devices")
+	p.mu.Lock()
+	p.announced = map[string]haAnnouncement{}
+	p.mu.Unlock()
+	p.collector.Lock()
+	devices := make([]string, 0, len(p.collector.Monitors))
+	for id := range p.collector.Monitors {
+		devices = append(devices, id)
+	}
+	p.collector.Unlock()
+	for _, d := range devices {
+		if s, ok := p.state(d); ok {
+			p.announce(s)
+		}
+	}
+}
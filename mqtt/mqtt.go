@@ -0,0 +1,297 @@
+// Package mqtt publishes the state of each monitored device to retained
+// MQTT topics, and its transitions, alerts and other events as they
+// happen.
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+var (
+	topicPrefix  = flag.String("mqtt-topic-prefix", "kasadutycycle", "Prefix of the MQTT topics published to")
+	qos          = flag.Int("mqtt-qos", 1, "QoS (0, 1 or 2) of MQTT publications")
+	clientID     = flag.String("mqtt-client-id", "", "MQTT client ID (default kasadutycycle-<hostname>)")
+	username     = flag.String("mqtt-username", "", "MQTT username")
+	passwordFile = flag.String("mqtt-password-file", "", "File holding the MQTT password")
+	tlsCA        = flag.String("mqtt-tls-ca", "", "PEM file of CA certificates trusted for the MQTT broker (default system roots)")
+	tlsCert      = flag.String("mqtt-tls-cert", "", "PEM client certificate for the MQTT broker")
+	tlsKey       = flag.String("mqtt-tls-key", "", "PEM key of -mqtt-tls-cert")
+	tlsInsecure  = flag.Bool("mqtt-tls-insecure", false, "Don't verify the MQTT broker's certificate")
+)
+
+const (
+	queueSize      = 100
+	publishTimeout = 10 * time.Second
+
+	online  = "online"
+	offline = "offline"
+)
+
+// State is published, retained, to <prefix>/<device>/state whenever a
+// device is sampled or has an event.
+type State struct {
+	collector.Identity
+	Time       time.Time `json:"time"`
+	On         bool      `json:"on"`
+	Unpowered  bool      `json:"unpowered"`
+	RelayState bool      `json:"relay_state"`
+	StateSince time.Time `json:"state_since"`
+
+	// metering plugs only
+	Power    *float64 `json:"power,omitempty"`
+	Voltage  *float64 `json:"voltage,omitempty"`
+	Current  *float64 `json:"current,omitempty"`
+	TotalKwH *float64 `json:"total_kwh,omitempty"`
+
+	LastOnDurationSeconds  float64  `json:"last_on_duration_seconds"`
+	LastOffDurationSeconds float64  `json:"last_off_duration_seconds"`
+	CycleCount             uint     `json:"cycle_count"`
+	AnomalyCount           uint     `json:"anomaly_count"`
+	Alerts                 []string `json:"alerts"` // firing
+}
+
+type message struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// Publisher is a collector.EventSink publishing to an MQTT broker.
+type Publisher struct {
+	collector *collector.Collector
+	client    paho.Client
+	qos       byte
+	discovery bool // announce devices to Home Assistant
+	queue     chan message
+	stop      chan struct{} // closed to give up connecting
+	done      chan struct{}
+
+	mu        sync.Mutex
+	closed    bool                      // queue
+	announced map[string]haAnnouncement // by device ID
+}
+
+// Topic returns the topic for a device's state or events, beneath the
+// configured prefix.
+func Topic(device, kind string) string {
+	return *topicPrefix + "/" + topicSafe(device) + "/" + kind
+}
+
+// StatusTopic is where the exporter's own availability is published.
+func StatusTopic() string {
+	return *topicPrefix + "/status"
+}
+
+var unsafe = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+func topicSafe(s string) string {
+	return unsafe.Replace(s)
+}
+
+func tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: *tlsInsecure}
+	if *tlsCA != "" {
+		b, err := os.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates in %s", *tlsCA)
+		}
+	}
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// New connects to broker (such as tcp://host:1883 or ssl://host:8883),
+// announcing the exporter online, and offline by last will should it go
+// away.  Connection is retried in the background.
+func New(c *collector.Collector, broker string) (*Publisher, error) {
+	if *qos < 0 || *qos > 2 {
+		return nil, fmt.Errorf("bad MQTT QoS %d", *qos)
+	}
+	p := &Publisher{
+		collector: c,
+		qos:       byte(*qos),
+		discovery: *haDiscovery,
+		queue:     make(chan message, queueSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		announced: map[string]haAnnouncement{},
+	}
+	opts := paho.NewClientOptions().
+		AddBroker(broker).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(StatusTopic(), offline, p.qos, true).
+		SetOnConnectHandler(func(client paho.Client) {
+			log.Printf("connected to MQTT broker %s", broker)
+			client.Publish(StatusTopic(), p.qos, true, online)
+			if p.discovery {
+				client.Subscribe(*haDiscoveryPrefix+"/status", p.qos, p.haStatus)
+			}
+		}).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			log.Printf("lost connection to MQTT broker %s: %v", broker, err)
+		})
+	id := *clientID
+	if id == "" {
+		host, _ := os.Hostname()
+		id = "kasadutycycle-" + host
+	}
+	opts.SetClientID(id)
+	if *username != "" {
+		opts.SetUsername(*username)
+	}
+	if *passwordFile != "" {
+		b, err := os.ReadFile(*passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading MQTT password: %w", err)
+		}
+		opts.SetPassword(strings.TrimSpace(string(b)))
+	}
+	if *tlsCA != "" || *tlsCert != "" || *tlsInsecure {
+		cfg, err := tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("configuring MQTT TLS: %w", err)
+		}
+		opts.SetTLSConfig(cfg)
+	}
+	p.client = paho.NewClient(opts)
+	go p.run(p.client.Connect())
+	return p, nil
+}
+
+// run publishes queued messages once connected.  Until then they queue,
+// and once the queue is full are dropped; state is republished every poll
+// regardless.
+func (p *Publisher) run(connected paho.Token) {
+	defer close(p.done)
+	select {
+	case <-connected.Done():
+	case <-p.stop:
+		return
+	}
+	for m := range p.queue {
+		t := p.client.Publish(m.topic, p.qos, m.retain, m.payload)
+		if !t.WaitTimeout(publishTimeout) {
+			log.Printf("timed out publishing to %s", m.topic)
+		} else if err := t.Error(); err != nil {
+			log.Printf("error publishing to %s: %v", m.topic, err)
+		}
+	}
+}
+
+func (p *Publisher) publish(topic string, v interface{}, retain bool) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error encoding %s: %v", topic, err)
+		return
+	}
+	p.queueRaw(topic, b, retain)
+}
+
+func (p *Publisher) queueRaw(topic string, b []byte, retain bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.queue <- message{topic, b, retain}:
+	default:
+		log.Printf("MQTT queue full, dropping message to %s", topic)
+	}
+}
+
+// HandleEvent implements collector.EventSink, publishing the device's
+// state, and the event itself unless it's a sample.
+func (p *Publisher) HandleEvent(e collector.Event) {
+	if s, ok := p.state(e.Device); ok {
+		if p.discovery {
+			p.announce(s)
+		}
+		p.publish(Topic(s.DeviceID, "state"), s, true)
+	}
+	if e.Type != collector.EventSample {
+		p.publish(Topic(e.Device, "event"), e, false)
+	}
+}
+
+// state snapshots the state of a device.
+func (p *Publisher) state(device string) (State, bool) {
+	p.collector.Lock()
+	defer p.collector.Unlock()
+	m := p.collector.Lookup(device)
+	if m == nil || m.State.Timestamp.IsZero() {
+		return State{}, false
+	}
+	s := State{
+		Identity:               m.Identity(),
+		Time:                   m.State.Timestamp,
+		On:                     m.State.CycleState,
+		Unpowered:              m.State.Unpowered,
+		RelayState:             m.State.RelayState,
+		StateSince:             m.State.LastOff,
+		LastOnDurationSeconds:  m.State.LastOnDuration.Seconds(),
+		LastOffDurationSeconds: m.State.LastOffDuration.Seconds(),
+		CycleCount:             m.State.CycleCount,
+		AnomalyCount:           m.State.AnomalyCount,
+		Alerts:                 []string{},
+	}
+	if m.State.CycleState {
+		s.StateSince = m.State.LastOn
+	}
+	if m.State.Metering {
+		power, voltage, current, total := m.State.Power, m.State.Voltage, m.State.Current, m.State.TotalKwH
+		s.Power, s.Voltage, s.Current, s.TotalKwH = &power, &voltage, &current, &total
+	}
+	for _, a := range m.State.FiringAlerts() {
+		s.Alerts = append(s.Alerts, a.Name)
+	}
+	return s, true
+}
+
+// Close publishes any queued messages, announces the exporter offline and
+// disconnects.
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.queue)
+	p.mu.Unlock()
+	if !p.client.IsConnectionOpen() {
+		close(p.stop)
+		<-p.done
+		p.client.Disconnect(0)
+		return
+	}
+	<-p.done
+	if t := p.client.Publish(StatusTopic(), p.qos, true, offline); !t.WaitTimeout(publishTimeout) {
+		log.Printf("timed out announcing offline to MQTT broker")
+	}
+	p.client.Disconnect(uint(time.Second / time.Millisecond))
+}
@@ -0,0 +1,235 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/jonboulle/clockwork"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+// broker is just enough of an MQTT broker to accept one client and record
+// what it publishes.
+type broker struct {
+	l net.Listener
+
+	mu        sync.Mutex
+	connect   *packets.ConnectPacket
+	published []*packets.PublishPacket
+}
+
+func newBroker(t *testing.T) *broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	b := &broker{l: l}
+	t.Cleanup(func() { l.Close() })
+	go b.serve()
+	return b
+}
+
+func (b *broker) serve() {
+	for {
+		conn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *broker) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			b.mu.Lock()
+			b.connect = p
+			b.mu.Unlock()
+			packets.NewControlPacket(packets.Connack).Write(conn)
+		case *packets.PublishPacket:
+			b.mu.Lock()
+			b.published = append(b.published, p)
+			b.mu.Unlock()
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				ack.Write(conn)
+			}
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = p.Qoss
+			ack.Write(conn)
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// last returns the last message published to topic, if any.
+func (b *broker) last(topic string) *packets.PublishPacket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := len(b.published) - 1; i >= 0; i-- {
+		if b.published[i].TopicName == topic {
+			return b.published[i]
+		}
+	}
+	return nil
+}
+
+// count returns the number of messages published to topic.
+func (b *broker) count(topic string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, p := range b.published {
+		if p.TopicName == topic {
+			n++
+		}
+	}
+	return n
+}
+
+// received is a paho.Message delivered to a subscriber.
+type received struct {
+	topic   string
+	payload []byte
+}
+
+func (m received) Duplicate() bool   { return false }
+func (m received) Qos() byte         { return 0 }
+func (m received) Retained() bool    { return false }
+func (m received) Topic() string     { return m.topic }
+func (m received) MessageID() uint16 { return 0 }
+func (m received) Payload() []byte   { return m.payload }
+func (m received) Ack()              {}
+
+// connect returns a Publisher connected to b.
+func connect(t *testing.T, b *broker, c *collector.Collector) *Publisher {
+	p, err := New(c, "tcp://"+b.l.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !p.client.IsConnectionOpen(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out connecting")
+		}
+	}
+	return p
+}
+
+func TestPublish(t *testing.T) {
+	b := newBroker(t)
+	c := collector.New([]string{"127.0.0.1"}, "", clockwork.NewFakeClock())
+	m := c.MonitorAt("127.0.0.1")
+	now := time.Date(2024, 3, 12, 20, 0, 0, 0, time.UTC)
+	m.State.Timestamp = now
+	m.State.Alias = "freezer"
+	m.State.Metering = true
+	m.State.Power = 90
+	m.State.CycleState = true
+	m.State.LastOn = now.Add(-time.Minute)
+	m.State.LastOffDuration = 20 * time.Minute
+	m.State.CycleCount = 7
+
+	p := connect(t, b, c)
+	p.HandleEvent(collector.Event{Time: now, Device: "127.0.0.1", Type: collector.EventSample})
+	p.HandleEvent(collector.Event{Time: now, Device: "127.0.0.1", Type: collector.EventOn, Duration: 20 * time.Minute})
+	p.Close()
+
+	b.mu.Lock()
+	connect := b.connect
+	b.mu.Unlock()
+	if connect == nil || !connect.WillFlag || connect.WillTopic != StatusTopic() || string(connect.WillMessage) != offline || !connect.WillRetain {
+		t.Errorf("want retained offline last will on %s, got %v", StatusTopic(), connect)
+	}
+
+	state := b.last(Topic("127.0.0.1", "state"))
+	if state == nil || !state.Retain {
+		t.Fatalf("want retained state, got %v", state)
+	}
+	var s State
+	if err := json.Unmarshal(state.Payload, &s); err != nil {
+		t.Fatalf("error decoding state %s: %v", state.Payload, err)
+	}
+	if !s.On || s.Power == nil || *s.Power != 90 || s.CycleCount != 7 || s.LastOffDurationSeconds != 1200 || s.Alias != "freezer" {
+		t.Errorf("unexpected state %s", state.Payload)
+	}
+
+	event := b.last(Topic("127.0.0.1", "event"))
+	if event == nil || event.Retain {
+		t.Fatalf("want unretained event, got %v", event)
+	}
+	var e collector.Event
+	if err := json.Unmarshal(event.Payload, &e); err != nil || e.Type != collector.EventOn {
+		t.Errorf("want on event, got %s (%v)", event.Payload, err)
+	}
+
+	if status := b.last(StatusTopic()); status == nil || string(status.Payload) != offline || !status.Retain {
+		t.Errorf("want retained offline status on close, got %v", status)
+	}
+
+	// events arriving after Close are dropped
+	p.HandleEvent(collector.Event{Time: now, Device: "127.0.0.1", Type: collector.EventOff})
+	p.Close()
+}
+
+func TestHomeAssistantDiscovery(t *testing.T) {
+	*haDiscovery = true
+	defer func() { *haDiscovery = false }()
+	b := newBroker(t)
+	c := collector.New([]string{"127.0.0.1", "127.0.0.2"}, "", clockwork.NewFakeClock())
+	now := time.Date(2024, 3, 12, 20, 0, 0, 0, time.UTC)
+	freezer := c.MonitorAt("127.0.0.1")
+	freezer.State.Timestamp = now
+	freezer.State.Alias = "freezer"
+	freezer.State.MAC = "aa:bb:cc:dd:ee:ff"
+	freezer.State.Model = "KP125(US)"
+	freezer.State.Metering = true
+	lamp := c.MonitorAt("127.0.0.2")
+	lamp.State.Timestamp = now
+
+	p := connect(t, b, c)
+	p.HandleEvent(collector.Event{Time: now, Device: freezer.Addr, Type: collector.EventSample})
+	p.HandleEvent(collector.Event{Time: now, Device: lamp.Addr, Type: collector.EventSample})
+	// Home Assistant restarting gets every device announced again at once
+	p.haStatus(p.client, received{"homeassistant/status", []byte(online)})
+	p.Close()
+	if n := b.count(HADiscoveryTopic("sensor", freezer.ID(), "power")); n != 2 {
+		t.Errorf("want power sensor announced twice, got %d", n)
+	}
+
+	msg := b.last(HADiscoveryTopic("sensor", freezer.ID(), "power"))
+	if msg == nil || !msg.Retain {
+		t.Fatalf("want retained power sensor config, got %v", msg)
+	}
+	var cfg haConfig
+	if err := json.Unmarshal(msg.Payload, &cfg); err != nil {
+		t.Fatalf("error decoding config %s: %v", msg.Payload, err)
+	}
+	if cfg.StateTopic != Topic(freezer.ID(), "state") || cfg.AvailabilityTopic != StatusTopic() ||
+		cfg.UnitOfMeasurement != "W" || cfg.Device.Name != "freezer" || cfg.Device.Model != "KP125(US)" ||
+		len(cfg.Device.Connections) != 1 || cfg.Device.Connections[0][1] != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("unexpected config %s", msg.Payload)
+	}
+	if msg := b.last(HADiscoveryTopic("binary_sensor", "127.0.0.2", "running")); msg == nil {
+		t.Errorf("want running sensor for non-metering plug")
+	}
+	if msg := b.last(HADiscoveryTopic("sensor", "127.0.0.2", "power")); msg != nil && len(msg.Payload) != 0 {
+		t.Errorf("want no power sensor for non-metering plug, got %s", msg.Payload)
+	}
+}
@@ -0,0 +1,293 @@
+// Package webhook POSTs collector events, such as completed cycles and
+// alerts, to HTTP endpoints.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of the request body, keyed
+// by the hook's secret, as "sha256=<hex>".
+const SignatureHeader = "X-Kasadutycycle-Signature-256"
+
+// EventHeader carries the event's type.
+const EventHeader = "X-Kasadutycycle-Event"
+
+const queueSize = 100
+
+// Hook is the configuration of a single webhook.
+type Hook struct {
+	Name string `json:"name,omitempty"`
+	URL  string `json:"url"`
+
+	// Events and Devices (ID, address or alias) restrict the events sent;
+	// by default every event but samples is sent.
+	Events  []collector.EventType `json:"events,omitempty"`
+	Devices []string              `json:"devices,omitempty"`
+
+	// Template is a text/template of the request body, executed with a
+	// Payload; by default the Payload is sent as JSON.
+	Template    string            `json:"template,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+
+	// Secret, if set, signs requests (see SignatureHeader).
+	Secret string `json:"secret,omitempty"`
+
+	Timeout    collector.Duration `json:"timeout,omitempty"`     // default 10s
+	Retries    *int               `json:"retries,omitempty"`     // default 3; 0 for none
+	RetryDelay collector.Duration `json:"retry_delay,omitempty"` // default 1s, doubling
+}
+
+// Payload is what's sent for each event: the event itself, with the rest
+// of its device's identity.
+type Payload struct {
+	collector.Event
+	MAC             string `json:"mac,omitempty"`
+	Model           string `json:"model,omitempty"`
+	SoftwareVersion string `json:"sw_ver,omitempty"`
+	HardwareVersion string `json:"hw_ver,omitempty"`
+}
+
+// Load reads a JSON list of Hooks from path.
+func Load(path string) ([]Hook, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []Hook
+	if err := json.Unmarshal(b, &hooks); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return hooks, nil
+}
+
+// Notifier is a collector.EventSink delivering events to webhooks.
+type Notifier struct {
+	collector *collector.Collector
+	hooks     []*hook
+	wg        sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+type hook struct {
+	Hook
+	retries int
+	tmpl    *template.Template
+	client  *http.Client
+	queue   chan Payload
+}
+
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// New starts delivering events to hooks.  Device identities are looked up
+// in c, if not nil.
+func New(c *collector.Collector, hooks []Hook) (*Notifier, error) {
+	n := &Notifier{collector: c}
+	for i, cfg := range hooks {
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("webhook %d: no url", i)
+		}
+		if cfg.Name == "" {
+			cfg.Name = cfg.URL
+		}
+		if cfg.Timeout == 0 {
+			cfg.Timeout = collector.Duration(10 * time.Second)
+		}
+		if cfg.RetryDelay == 0 {
+			cfg.RetryDelay = collector.Duration(time.Second)
+		}
+		h := &hook{
+			Hook:    cfg,
+			retries: 3,
+			client:  &http.Client{Timeout: time.Duration(cfg.Timeout)},
+			queue:   make(chan Payload, queueSize),
+		}
+		if cfg.Retries != nil {
+			h.retries = *cfg.Retries
+		}
+		if cfg.Template != "" {
+			t, err := template.New(cfg.Name).Funcs(funcs).Parse(cfg.Template)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %s: %w", cfg.Name, err)
+			}
+			h.tmpl = t
+		}
+		n.hooks = append(n.hooks, h)
+	}
+	for _, h := range n.hooks {
+		n.wg.Add(1)
+		go func(h *hook) {
+			defer n.wg.Done()
+			for p := range h.queue {
+				if err := h.deliver(p); err != nil {
+					log.Printf("webhook %s: giving up on %s event for %s: %v", h.Name, p.Type, p.Device, err)
+				}
+			}
+		}(h)
+	}
+	return n, nil
+}
+
+// HandleEvent implements collector.EventSink, queueing the event for each
+// hook which wants it.  Events are dropped for hooks too far behind.
+func (n *Notifier) HandleEvent(e collector.Event) {
+	p := Payload{Event: e}
+	if n.collector != nil {
+		if id, ok := n.collector.Identify(e.Device); ok {
+			p.MAC, p.Model, p.SoftwareVersion, p.HardwareVersion = id.MAC, id.Model, id.SoftwareVersion, id.HardwareVersion
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	for _, h := range n.hooks {
+		if !h.wants(p) {
+			continue
+		}
+		select {
+		case h.queue <- p:
+		default:
+			log.Printf("webhook %s: queue full, dropping %s event for %s", h.Name, e.Type, e.Device)
+		}
+	}
+}
+
+// Close stops accepting events, and waits for those queued to be
+// delivered.
+func (n *Notifier) Close() {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		for _, h := range n.hooks {
+			close(h.queue)
+		}
+	}
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+func (h *hook) wants(p Payload) bool {
+	if len(h.Events) == 0 {
+		if p.Type == collector.EventSample {
+			return false
+		}
+	} else if !contains(h.Events, p.Type) {
+		return false
+	}
+	if len(h.Devices) == 0 {
+		return true
+	}
+	for _, d := range h.Devices {
+		if d == p.Device || d == p.Addr || (p.Alias != "" && strings.EqualFold(d, p.Alias)) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(types []collector.EventType, t collector.EventType) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *hook) body(p Payload) ([]byte, error) {
+	if h.tmpl == nil {
+		return json.Marshal(p)
+	}
+	var b bytes.Buffer
+	if err := h.tmpl.Execute(&b, p); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// deliver POSTs p, retrying server errors with exponential backoff.
+func (h *hook) deliver(p Payload) error {
+	body, err := h.body(p)
+	if err != nil {
+		return fmt.Errorf("executing template: %w", err)
+	}
+	delay := time.Duration(h.RetryDelay)
+	for attempt := 0; ; attempt++ {
+		retry, err := h.post(p, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= h.retries {
+			return err
+		}
+		log.Printf("webhook %s: %v; retrying in %s", h.Name, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post makes a single delivery attempt, returning whether a failure is
+// worth retrying.
+func (h *hook) post(p Payload, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	contentType := h.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(EventHeader, string(p.Type))
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	if h.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Sign([]byte(h.Secret), body))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusRequestTimeout:
+		return true, fmt.Errorf("%s", resp.Status)
+	default:
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of body keyed by secret, for receivers
+// to check SignatureHeader against.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,168 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aqua/kasadutycycle/collector"
+)
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver records requests, failing the first failures of them.
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	requests []request
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	r.requests = append(r.requests, request{req.Header, body})
+}
+
+func (r *receiver) received() []request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]request(nil), r.requests...)
+}
+
+var (
+	start = time.Date(2024, 3, 12, 20, 0, 0, 0, time.UTC)
+	off   = collector.Event{
+		Time:            start,
+		Device:          "FFFF",
+		Alias:           "freezer",
+		Addr:            "127.0.0.1",
+		Type:            collector.EventOff,
+		Duration:        10 * time.Minute,
+		DurationSeconds: 600,
+		Power:           0.5,
+	}
+)
+
+func TestDeliver(t *testing.T) {
+	r := &receiver{failures: 2}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	n, err := New(nil, []Hook{{
+		URL:        srv.URL,
+		Secret:     "sekrit",
+		RetryDelay: collector.Duration(time.Millisecond),
+	}})
+	if err != nil {
+		t.Fatalf("error creating notifier: %v", err)
+	}
+	n.HandleEvent(collector.Event{Time: start, Device: "FFFF", Type: collector.EventSample})
+	n.HandleEvent(off)
+	n.Close()
+
+	reqs := r.received()
+	if len(reqs) != 1 {
+		t.Fatalf("want 1 request (samples filtered, retries succeeding), got %d", len(reqs))
+	}
+	req := reqs[0]
+	if got, want := req.header.Get(SignatureHeader), "sha256="+Sign([]byte("sekrit"), req.body); got != want {
+		t.Errorf("want signature %s, got %s", want, got)
+	}
+	if got := req.header.Get(EventHeader); got != string(collector.EventOff) {
+		t.Errorf("want event header %s, got %s", collector.EventOff, got)
+	}
+	var p Payload
+	if err := json.Unmarshal(req.body, &p); err != nil {
+		t.Fatalf("error decoding payload %s: %v", req.body, err)
+	}
+	if p.Device != "FFFF" || p.Alias != "freezer" || p.Type != collector.EventOff || p.DurationSeconds != 600 {
+		t.Errorf("unexpected payload %s", req.body)
+	}
+}
+
+func TestTemplateAndFilters(t *testing.T) {
+	r := &receiver{}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	n, err := New(nil, []Hook{{
+		URL:         srv.URL,
+		Events:      []collector.EventType{collector.EventOff},
+		Devices:     []string{"Freezer"},
+		Template:    `{"text": "{{.Alias}} ran for {{.DurationSeconds}}s", "event": {{json .Type}}}`,
+		ContentType: "application/vnd.test+json",
+	}})
+	if err != nil {
+		t.Fatalf("error creating notifier: %v", err)
+	}
+	on := off
+	on.Type = collector.EventOn
+	fridge := off
+	fridge.Device, fridge.Alias, fridge.Addr = "EEEE", "fridge", "127.0.0.2"
+	for _, e := range []collector.Event{on, fridge, off} {
+		n.HandleEvent(e)
+	}
+	n.Close()
+
+	reqs := r.received()
+	if len(reqs) != 1 {
+		t.Fatalf("want 1 request, got %d", len(reqs))
+	}
+	if want := `{"text": "freezer ran for 600s", "event": "off"}`; string(reqs[0].body) != want {
+		t.Errorf("want body %s, got %s", want, reqs[0].body)
+	}
+	if got := reqs[0].header.Get("Content-Type"); got != "application/vnd.test+json" {
+		t.Errorf("want configured content type, got %s", got)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	var calls int
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		http.Error(w, "bad", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	n, err := New(nil, []Hook{{URL: srv.URL, RetryDelay: collector.Duration(time.Millisecond)}})
+	if err != nil {
+		t.Fatalf("error creating notifier: %v", err)
+	}
+	n.HandleEvent(off)
+	n.Close()
+	if calls != 1 {
+		t.Errorf("want 1 attempt, got %d", calls)
+	}
+}
+
+func TestRetriesDisabled(t *testing.T) {
+	r := &receiver{failures: 1}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	none := 0
+	n, err := New(nil, []Hook{{URL: srv.URL, Retries: &none, RetryDelay: collector.Duration(time.Millisecond)}})
+	if err != nil {
+		t.Fatalf("error creating notifier: %v", err)
+	}
+	n.HandleEvent(off)
+	n.Close()
+	if reqs := r.received(); len(reqs) != 0 {
+		t.Errorf("want no retry, got %d requests", len(reqs))
+	}
+	// events arriving after Close are dropped
+	n.HandleEvent(off)
+	n.Close()
+}